@@ -3,6 +3,8 @@
 #include <assert.h>
 #include <aom/aom_encoder.h>
 #include <aom/aomcx.h>
+#include <aom/aom_decoder.h>
+#include <aom/aomdx.h>
 #include "av1.h"
 
 #define SET_CODEC_CONTROL(ctrl, val) \
@@ -14,9 +16,12 @@ typedef struct {
   int dst_c_dec_v;
   int bps;
   int bytes_per_sample;
+  unsigned int profile;
+  int monochrome;
 } avif_format;
 
-static avif_format convert_subsampling(const avif_subsampling subsampling) {
+static avif_format convert_subsampling(const avif_subsampling subsampling,
+                                       const uint8_t bit_depth) {
   avif_format fmt = { 0 };
   switch (subsampling) {
   case AVIF_SUBSAMPLING_I420:
@@ -25,19 +30,63 @@ static avif_format convert_subsampling(const avif_subsampling subsampling) {
     fmt.dst_c_dec_v = 2;
     fmt.bps = 12;
     fmt.bytes_per_sample = 1;
+    fmt.profile = 0;
+    break;
+  case AVIF_SUBSAMPLING_I422:
+    fmt.fmt = AOM_IMG_FMT_I422;
+    fmt.dst_c_dec_h = 2;
+    fmt.dst_c_dec_v = 1;
+    fmt.bps = 16;
+    fmt.bytes_per_sample = 1;
+    fmt.profile = 2;
+    break;
+  case AVIF_SUBSAMPLING_I444:
+    fmt.fmt = AOM_IMG_FMT_I444;
+    fmt.dst_c_dec_h = 1;
+    fmt.dst_c_dec_v = 1;
+    fmt.bps = 24;
+    fmt.bytes_per_sample = 1;
+    fmt.profile = 1;
+    break;
+  case AVIF_SUBSAMPLING_I400:
+    // Monochrome is coded as 4:2:0 with chroma planes omitted.
+    fmt.fmt = AOM_IMG_FMT_I420;
+    fmt.dst_c_dec_h = 2;
+    fmt.dst_c_dec_v = 2;
+    fmt.bps = 12;
+    fmt.bytes_per_sample = 1;
+    fmt.profile = 0;
+    fmt.monochrome = 1;
     break;
   default:
     assert(0);
   }
+  if (bit_depth > 8) {
+    fmt.fmt |= AOM_IMG_FMT_HIGHBITDEPTH;
+    fmt.bps *= 2;
+    fmt.bytes_per_sample = 2;
+  }
+  if (bit_depth == 12) {
+    // 12-bit is only allowed in professional profile.
+    fmt.profile = 2;
+  }
   return fmt;
 }
 
 // We don't use aom_img_wrap() because it forces padding for odd picture
 // sizes (c) libaom/common/y4minput.c
-static void convert_frame(const avif_frame *frame, aom_image_t *aom_frame) {
+//
+// Monochrome frames only carry luma plane but libaom still reads chroma
+// planes, so they are pointed to the allocated neutral gray buffer which
+// must be freed by the caller.
+static avif_error convert_frame(const avif_frame *frame,
+                                aom_image_t *aom_frame,
+                                void **gray) {
   memset(aom_frame, 0, sizeof(*aom_frame));
-  avif_format fmt = convert_subsampling(frame->subsampling);
+  avif_format fmt = convert_subsampling(frame->subsampling, frame->bit_depth);
   aom_frame->fmt = fmt.fmt;
+  aom_frame->bit_depth = frame->bit_depth;
+  aom_frame->monochrome = fmt.monochrome;
   aom_frame->w = aom_frame->d_w = frame->width;
   aom_frame->h = aom_frame->d_h = frame->height;
   aom_frame->x_chroma_shift = fmt.dst_c_dec_h >> 1;
@@ -51,25 +100,55 @@ static void convert_frame(const avif_frame *frame, aom_image_t *aom_frame) {
   aom_frame->stride[AOM_PLANE_Y] = frame->width * fmt.bytes_per_sample;
   aom_frame->stride[AOM_PLANE_U] = aom_frame->stride[AOM_PLANE_V] = c_w;
   aom_frame->planes[AOM_PLANE_Y] = frame->data;
-  aom_frame->planes[AOM_PLANE_U] = frame->data + pic_sz;
-  aom_frame->planes[AOM_PLANE_V] = frame->data + pic_sz + c_sz;
+  if (fmt.monochrome) {
+    *gray = malloc(c_sz);
+    if (!*gray)
+      return AVIF_ERROR_NO_MEMORY;
+    if (fmt.bytes_per_sample == 2) {
+      uint16_t *gray16 = *gray;
+      for (int i = 0; i < c_sz / 2; i++)
+        gray16[i] = 1 << (frame->bit_depth - 1);
+    } else {
+      memset(*gray, 128, c_sz);
+    }
+    aom_frame->planes[AOM_PLANE_U] = aom_frame->planes[AOM_PLANE_V] = *gray;
+  } else {
+    aom_frame->planes[AOM_PLANE_U] = frame->data + pic_sz;
+    aom_frame->planes[AOM_PLANE_V] = frame->data + pic_sz + c_sz;
+  }
+  return AVIF_OK;
+}
+
+// Cancel flag is set from another thread.
+static int is_canceled(const avif_config *cfg) {
+  return cfg->canceled && __atomic_load_n(cfg->canceled, __ATOMIC_RELAXED);
 }
 
 static int get_frame_stats(aom_codec_ctx_t *ctx,
                            const aom_image_t *frame,
-                           aom_fixed_buf_t *stats) {
-  if (aom_codec_encode(ctx, frame, 1/*pts*/, 1/*duration*/, 0/*flags*/))
+                           aom_codec_pts_t pts,
+                           unsigned long duration,
+                           aom_fixed_buf_t *stats,
+                           const avif_config *cfg) {
+  if (is_canceled(cfg))
+    return AVIF_ERROR_CANCELED;
+  if (aom_codec_encode(ctx, frame, pts, duration, 0/*flags*/))
     return AVIF_ERROR_FRAME_ENCODE;
 
   const aom_codec_cx_pkt_t *pkt = NULL;
   aom_codec_iter_t iter = NULL;
   int got_pkts = 0;
   while ((pkt = aom_codec_get_cx_data(ctx, &iter)) != NULL) {
+    if (is_canceled(cfg))
+      return AVIF_ERROR_CANCELED;
     got_pkts = 1;
     if (pkt->kind == AOM_CODEC_STATS_PKT) {
       const uint8_t *const pkt_buf = pkt->data.twopass_stats.buf;
       const size_t pkt_size = pkt->data.twopass_stats.sz;
-      stats->buf = realloc(stats->buf, stats->sz + pkt_size);
+      void *buf = realloc(stats->buf, stats->sz + pkt_size);
+      if (!buf)
+        return AVIF_ERROR_NO_MEMORY;
+      stats->buf = buf;
       memcpy((uint8_t *)stats->buf + stats->sz, pkt_buf, pkt_size);
       stats->sz += pkt_size;
     }
@@ -77,139 +156,468 @@ static int get_frame_stats(aom_codec_ctx_t *ctx,
   return got_pkts;
 }
 
+// Coded frames received from the encoder. Invisible frames are packed by
+// libaom with the next visible one so there is one packet per input
+// frame.
+typedef struct {
+  avif_buffer *obus;
+  int *keyframes;
+  int count;
+  int received;
+} avif_packets;
+
 static int encode_frame(aom_codec_ctx_t *ctx,
                         const aom_image_t *frame,
-                        avif_buffer *obu) {
-  if (aom_codec_encode(ctx, frame, 1/*pts*/, 1/*duration*/, 0/*flags*/))
+                        aom_codec_pts_t pts,
+                        unsigned long duration,
+                        avif_packets *out,
+                        const avif_config *cfg) {
+  if (is_canceled(cfg))
+    return AVIF_ERROR_CANCELED;
+  if (aom_codec_encode(ctx, frame, pts, duration, 0/*flags*/))
     return AVIF_ERROR_FRAME_ENCODE;
 
   const aom_codec_cx_pkt_t *pkt = NULL;
   aom_codec_iter_t iter = NULL;
   int got_pkts = 0;
   while ((pkt = aom_codec_get_cx_data(ctx, &iter)) != NULL) {
+    if (is_canceled(cfg))
+      return AVIF_ERROR_CANCELED;
     got_pkts = 1;
     if (pkt->kind == AOM_CODEC_CX_FRAME_PKT) {
+      if (out->received >= out->count)
+        return AVIF_ERROR_FRAME_ENCODE;
+      avif_buffer *obu = &out->obus[out->received];
       const uint8_t *const pkt_buf = pkt->data.frame.buf;
       const size_t pkt_size = pkt->data.frame.sz;
-      obu->buf = realloc(obu->buf, obu->sz + pkt_size);
+      void *buf = realloc(obu->buf, obu->sz + pkt_size);
+      if (!buf)
+        return AVIF_ERROR_NO_MEMORY;
+      obu->buf = buf;
       memcpy((uint8_t *)obu->buf + obu->sz, pkt_buf, pkt_size);
       obu->sz += pkt_size;
+      if (out->keyframes)
+        out->keyframes[out->received] =
+          (pkt->data.frame.flags & AOM_FRAME_IS_KEY) != 0;
+      out->received++;
     }
   }
   return got_pkts;
 }
 
-static avif_error init_codec(aom_codec_iface_t *iface,
-                             aom_codec_ctx_t *ctx,
-                             const aom_codec_enc_cfg_t *aom_cfg,
-                             const avif_config *cfg) {
-  if (aom_codec_enc_init(ctx, iface, aom_cfg, 0))
-    return AVIF_ERROR_CODEC_INIT;
+// Split the frame into as many tiles as there are threads so they can be
+// decoded in parallel, but keep them large enough since every tile costs
+// bits and restricts prediction. The longer tile side is split first.
+static void auto_tiles(const aom_codec_enc_cfg_t *aom_cfg,
+                       int *rows_log2,
+                       int *cols_log2) {
+  enum { MIN_TILE_AREA = 512 * 512 };
+  uint64_t area = (uint64_t)aom_cfg->g_w * aom_cfg->g_h;
+  uint64_t tiles = area / MIN_TILE_AREA;
+  if (tiles > aom_cfg->g_threads)
+    tiles = aom_cfg->g_threads;
+  unsigned int w = aom_cfg->g_w, h = aom_cfg->g_h;
+  *rows_log2 = *cols_log2 = 0;
+  for (uint64_t n = 2; n <= tiles; n *= 2) {
+    if (w >= h) {
+      (*cols_log2)++;
+      w /= 2;
+    } else {
+      (*rows_log2)++;
+      h /= 2;
+    }
+  }
+}
+
+static avif_error set_controls(aom_codec_ctx_t *ctx,
+                               const aom_codec_enc_cfg_t *aom_cfg,
+                               const avif_config *cfg) {
+  int rows_log2 = cfg->tile_rows_log2, cols_log2 = cfg->tile_cols_log2;
+  if (rows_log2 == AVIF_TILES_AUTO || cols_log2 == AVIF_TILES_AUTO) {
+    int auto_rows_log2, auto_cols_log2;
+    auto_tiles(aom_cfg, &auto_rows_log2, &auto_cols_log2);
+    if (rows_log2 == AVIF_TILES_AUTO)
+      rows_log2 = auto_rows_log2;
+    if (cols_log2 == AVIF_TILES_AUTO)
+      cols_log2 = auto_cols_log2;
+  }
 
   SET_CODEC_CONTROL(AOME_SET_CPUUSED, cfg->speed)
   SET_CODEC_CONTROL(AOME_SET_CQ_LEVEL, cfg->quality)
   if (cfg->quality == 0) {
     SET_CODEC_CONTROL(AV1E_SET_LOSSLESS, 1)
   }
+  SET_CODEC_CONTROL(AV1E_SET_COLOR_RANGE, cfg->full_range)
+  SET_CODEC_CONTROL(AV1E_SET_COLOR_PRIMARIES, cfg->color_primaries)
+  SET_CODEC_CONTROL(AV1E_SET_TRANSFER_CHARACTERISTICS,
+                    cfg->transfer_characteristics)
+  SET_CODEC_CONTROL(AV1E_SET_MATRIX_COEFFICIENTS, cfg->matrix_coefficients)
+  SET_CODEC_CONTROL(AV1E_SET_CHROMA_SAMPLE_POSITION, cfg->chroma_sample_position)
+  SET_CODEC_CONTROL(AOME_SET_TUNING,
+                    cfg->tune == AVIF_TUNE_SSIM ? AOM_TUNE_SSIM : AOM_TUNE_PSNR)
+  SET_CODEC_CONTROL(AOME_SET_SHARPNESS, cfg->sharpness)
+  if (cfg->aq_mode != AVIF_MODE_DEFAULT) {
+    SET_CODEC_CONTROL(AV1E_SET_AQ_MODE, cfg->aq_mode)
+  }
+  if (cfg->deltaq_mode != AVIF_MODE_DEFAULT) {
+    SET_CODEC_CONTROL(AV1E_SET_DELTAQ_MODE, cfg->deltaq_mode)
+  }
+#ifdef AOM_CTRL_AV1E_SET_ENABLE_CHROMA_DELTAQ
+  SET_CODEC_CONTROL(AV1E_SET_ENABLE_CHROMA_DELTAQ, cfg->chroma_deltaq)
+#endif
+  SET_CODEC_CONTROL(AV1E_SET_ENABLE_QM, cfg->enable_qm)
+  if (cfg->denoise_level) {
+    SET_CODEC_CONTROL(AV1E_SET_DENOISE_NOISE_LEVEL, cfg->denoise_level)
+  }
   SET_CODEC_CONTROL(AV1E_SET_FRAME_PARALLEL_DECODING, 0)
-  SET_CODEC_CONTROL(AV1E_SET_TILE_COLUMNS, 1)
-  SET_CODEC_CONTROL(AV1E_SET_TILE_ROWS, 1)
+  SET_CODEC_CONTROL(AV1E_SET_TILE_COLUMNS, cols_log2)
+  SET_CODEC_CONTROL(AV1E_SET_TILE_ROWS, rows_log2)
 #ifdef AOM_CTRL_AV1E_SET_ROW_MT
   SET_CODEC_CONTROL(AV1E_SET_ROW_MT, 1)
 #endif
+  if (cfg->still_picture) {
+    // Tools predicting from other frames are useless for a single one
+    // and only cost header bits.
+#ifdef AOM_CTRL_AV1E_SET_FORCE_VIDEO_MODE
+    SET_CODEC_CONTROL(AV1E_SET_FORCE_VIDEO_MODE, 0)
+#endif
+#ifdef AOM_CTRL_AV1E_SET_ENABLE_SUPERRES
+    SET_CODEC_CONTROL(AV1E_SET_ENABLE_SUPERRES, 0)
+#endif
+#ifdef AOM_CTRL_AV1E_SET_ENABLE_TPL_MODEL
+    // Unless it's explicitly requested for objective delta q mode.
+    if (cfg->deltaq_mode != AVIF_DELTAQ_OBJECTIVE) {
+      SET_CODEC_CONTROL(AV1E_SET_ENABLE_TPL_MODEL, 0)
+    }
+#endif
+#ifdef AOM_CTRL_AV1E_SET_ENABLE_KEYFRAME_FILTERING
+    SET_CODEC_CONTROL(AV1E_SET_ENABLE_KEYFRAME_FILTERING, 0)
+#endif
+#ifdef AOM_CTRL_AV1E_SET_ENABLE_ORDER_HINT
+    SET_CODEC_CONTROL(AV1E_SET_ENABLE_ORDER_HINT, 0)
+#endif
+  }
 
   return AVIF_OK;
 }
 
-static avif_error do_pass1(aom_codec_ctx_t *ctx,
-                           const aom_image_t *frame,
-                           aom_fixed_buf_t *stats) {
-  avif_error res = AVIF_OK;
-
-  // Calculate frame statistics.
-  if ((res = get_frame_stats(ctx, frame, stats)) < 0)
-    goto fail;
-
-  // Flush encoder.
-  while ((res = get_frame_stats(ctx, NULL, stats)) > 0)
-    continue;
+// Codec is only left initialized on success.
+static avif_error init_codec(aom_codec_iface_t *iface,
+                             aom_codec_ctx_t *ctx,
+                             const aom_codec_enc_cfg_t *aom_cfg,
+                             const avif_config *cfg) {
+  aom_codec_flags_t flags = 0;
+  if (aom_cfg->g_bit_depth > AOM_BITS_8)
+    flags |= AOM_CODEC_USE_HIGHBITDEPTH;
+  if (aom_codec_enc_init(ctx, iface, aom_cfg, flags))
+    return AVIF_ERROR_CODEC_INIT;
 
-fail:
-  return res < 0 ? res : AVIF_OK;
+  avif_error res = set_controls(ctx, aom_cfg, cfg);
+  if (res)
+    aom_codec_destroy(ctx);
+  return res;
 }
 
-static avif_error do_pass2(aom_codec_ctx_t *ctx,
-                           const aom_image_t *frame,
-                           avif_buffer *obu) {
-  avif_error res = AVIF_OK;
-
-  // Encode frame.
-  if ((res = encode_frame(ctx, frame, obu)) < 0)
-    goto fail;
-
-  // Flush encoder.
-  while ((res = encode_frame(ctx, NULL, obu)) > 0)
-    continue;
+struct avif_session {
+  avif_config cfg;
+  avif_subsampling subsampling;
+  aom_codec_iface_t *iface;
+  aom_codec_enc_cfg_t aom_cfg;
+  aom_codec_ctx_t codec;
+  int codec_inited;
+  // Number of started passes, only the last one outputs coded frames.
+  int pass;
+  int count;
+  int added;
+  aom_codec_pts_t pts;
+  aom_fixed_buf_t stats;
+  avif_packets out;
+};
 
-fail:
-  return res < 0 ? res : AVIF_OK;
+static int is_last_pass(const avif_session *s) {
+  return s->pass == s->cfg.passes;
 }
 
-avif_error avif_encode_frame(const avif_config *cfg,
-                             const avif_frame *frame,
-                             avif_buffer *obu) {
+avif_error avif_session_create(const avif_config *cfg,
+                               const avif_frame *format,
+                               int count,
+                               int timescale,
+                               avif_session **session) {
   // Validation.
   assert(cfg->threads >= 1);
   assert(cfg->speed >= AVIF_MIN_SPEED && cfg->speed <= AVIF_MAX_SPEED);
   assert(cfg->quality >= AVIF_MIN_QUALITY && cfg->quality <= AVIF_MAX_QUALITY);
-  assert(frame->width && frame->height);
+  assert(cfg->sharpness >= 0 && cfg->sharpness <= AVIF_MAX_SHARPNESS);
+  assert(cfg->aq_mode >= AVIF_MODE_DEFAULT &&
+         cfg->aq_mode <= AVIF_MAX_AQ_MODE);
+  assert(cfg->deltaq_mode >= AVIF_MODE_DEFAULT &&
+         cfg->deltaq_mode <= AVIF_MAX_DELTAQ_MODE);
+  assert(cfg->min_quantizer >= AVIF_MIN_QUALITY &&
+         cfg->min_quantizer <= cfg->max_quantizer &&
+         cfg->max_quantizer <= AVIF_MAX_QUALITY);
+  assert(cfg->denoise_level >= 0 &&
+         cfg->denoise_level <= AVIF_MAX_DENOISE_LEVEL);
+  assert(cfg->tile_rows_log2 >= AVIF_TILES_AUTO &&
+         cfg->tile_rows_log2 <= AVIF_MAX_TILES_LOG2);
+  assert(cfg->tile_cols_log2 >= AVIF_TILES_AUTO &&
+         cfg->tile_cols_log2 <= AVIF_MAX_TILES_LOG2);
+  assert(cfg->passes == 1 || cfg->passes == 2);
+  assert(count >= 1 && timescale >= 1);
+  assert(!cfg->still_picture || count == 1);
+  assert(format->width && format->height);
+  assert(format->bit_depth == 8 || format->bit_depth == 10 ||
+         format->bit_depth == 12);
+#ifndef AOM_CTRL_AV1E_SET_ENABLE_CHROMA_DELTAQ
+  // Older libaom doesn't adjust chroma quantizers.
+  if (cfg->chroma_deltaq)
+    return AVIF_ERROR_UNSUPPORTED;
+#endif
 
-  // Prepare image.
-  aom_image_t aom_frame;
-  convert_frame(frame, &aom_frame);
+  avif_session *s = calloc(1, sizeof(avif_session));
+  if (!s)
+    return AVIF_ERROR_NO_MEMORY;
+  s->cfg = *cfg;
+  s->subsampling = format->subsampling;
+  s->count = count;
+  s->out.count = count;
+  s->out.obus = calloc(count, sizeof(avif_buffer));
+  s->out.keyframes = calloc(count, sizeof(int));
+  if (!s->out.obus || !s->out.keyframes) {
+    avif_session_destroy(s);
+    return AVIF_ERROR_NO_MEMORY;
+  }
 
   // Setup codec.
-  avif_error res = AVIF_OK;
-  aom_codec_ctx_t codec;
-  aom_fixed_buf_t stats = { NULL, 0 };
-  aom_codec_iface_t *iface = aom_codec_av1_cx();
-  aom_codec_enc_cfg_t aom_cfg;
-  if (aom_codec_enc_config_default(iface, &aom_cfg, 0)) {
-    res = AVIF_ERROR_CODEC_INIT;
-    goto fail;
+  avif_format fmt = convert_subsampling(format->subsampling, format->bit_depth);
+  s->iface = aom_codec_av1_cx();
+  aom_codec_enc_cfg_t *aom_cfg = &s->aom_cfg;
+  if (aom_codec_enc_config_default(s->iface, aom_cfg, 0)) {
+    avif_session_destroy(s);
+    return AVIF_ERROR_CODEC_INIT;
   }
-  aom_cfg.g_limit = 1;
-  aom_cfg.g_w = frame->width;
-  aom_cfg.g_h = frame->height;
-  aom_cfg.g_timebase.num = 1;
-  aom_cfg.g_timebase.den = 24;
-  aom_cfg.rc_end_usage = AOM_Q;
-  aom_cfg.g_threads = cfg->threads;
-
-  // Pass 1.
-  aom_cfg.g_pass = AOM_RC_FIRST_PASS;
-  if ((res = init_codec(iface, &codec, &aom_cfg, cfg)))
-    goto fail;
-  if ((res = do_pass1(&codec, &aom_frame, &stats)))
-    goto fail;
-  if (aom_codec_destroy(&codec)) {
+  aom_cfg->g_profile = fmt.profile;
+  aom_cfg->monochrome = fmt.monochrome;
+  aom_cfg->g_bit_depth = format->bit_depth;
+  aom_cfg->g_input_bit_depth = format->bit_depth;
+  aom_cfg->g_limit = count;
+  aom_cfg->g_w = format->width;
+  aom_cfg->g_h = format->height;
+  aom_cfg->g_timebase.num = 1;
+  aom_cfg->g_timebase.den = timescale;
+  aom_cfg->rc_end_usage = AOM_Q;
+  if (cfg->quality) {
+    // Lossless coding needs zero quantizer.
+    aom_cfg->rc_min_quantizer = cfg->min_quantizer;
+    aom_cfg->rc_max_quantizer = cfg->max_quantizer;
+  }
+  aom_cfg->g_threads = cfg->threads;
+  if (cfg->still_picture) {
+    // Reduced still picture header is only emitted for the single key
+    // frame without lookahead and timing info.
+    aom_cfg->full_still_picture_hdr = 0;
+    aom_cfg->g_lag_in_frames = 0;
+    aom_cfg->kf_max_dist = 0;
+    aom_cfg->rc_superres_mode = AOM_SUPERRES_NONE;
+  }
+  *session = s;
+  return AVIF_OK;
+}
+
+avif_error avif_session_begin_pass(avif_session *s) {
+  assert(!s->codec_inited && s->pass < s->cfg.passes);
+  s->pass++;
+  if (s->cfg.passes == 1) {
+    s->aom_cfg.g_pass = AOM_RC_ONE_PASS;
+  } else if (!is_last_pass(s)) {
+    s->aom_cfg.g_pass = AOM_RC_FIRST_PASS;
+  } else {
+    s->aom_cfg.g_pass = AOM_RC_LAST_PASS;
+    s->aom_cfg.rc_twopass_stats_in = s->stats;
+  }
+  avif_error res = init_codec(s->iface, &s->codec, &s->aom_cfg, &s->cfg);
+  if (res)
+    return res;
+  s->codec_inited = 1;
+  s->added = 0;
+  s->pts = 0;
+  return AVIF_OK;
+}
+
+avif_error avif_session_add_frame(avif_session *s,
+                                  const avif_frame *frame,
+                                  int duration) {
+  assert(s->codec_inited && s->added < s->count);
+  assert(frame->width == s->aom_cfg.g_w && frame->height == s->aom_cfg.g_h);
+  assert(frame->subsampling == s->subsampling &&
+         frame->bit_depth == s->aom_cfg.g_bit_depth);
+  assert(duration >= 1);
+
+  aom_image_t aom_frame;
+  void *gray = NULL;
+  int res = convert_frame(frame, &aom_frame, &gray);
+  if (!res) {
+    // Calculate frame statistics in the first pass.
+    if (is_last_pass(s))
+      res = encode_frame(&s->codec, &aom_frame, s->pts, duration, &s->out,
+                         &s->cfg);
+    else
+      res = get_frame_stats(&s->codec, &aom_frame, s->pts, duration,
+                            &s->stats, &s->cfg);
+  }
+  free(gray);
+  if (res < 0)
+    return res;
+  s->pts += duration;
+  s->added++;
+  return AVIF_OK;
+}
+
+avif_error avif_session_end_pass(avif_session *s) {
+  assert(s->codec_inited && s->added == s->count);
+  int res;
+
+  // Flush encoder.
+  if (is_last_pass(s)) {
+    while ((res = encode_frame(&s->codec, NULL, s->pts, 1, &s->out,
+                               &s->cfg)) > 0)
+      continue;
+    if (res == 0 && s->out.received != s->count)
+      res = AVIF_ERROR_FRAME_ENCODE;
+  } else {
+    while ((res = get_frame_stats(&s->codec, NULL, s->pts, 1, &s->stats,
+                                  &s->cfg)) > 0)
+      continue;
+  }
+
+  s->codec_inited = 0;
+  if (aom_codec_destroy(&s->codec) && res >= 0)
     res = AVIF_ERROR_CODEC_DESTROY;
-    goto fail;
+  if (res >= 0 && is_canceled(&s->cfg))
+    res = AVIF_ERROR_CANCELED;
+  return res < 0 ? res : AVIF_OK;
+}
+
+void avif_session_take_frame(avif_session *s,
+                             int i,
+                             avif_buffer *obu,
+                             int *keyframe) {
+  assert(i >= 0 && i < s->out.received);
+  *obu = s->out.obus[i];
+  *keyframe = s->out.keyframes[i];
+  s->out.obus[i].buf = NULL;
+  s->out.obus[i].sz = 0;
+}
+
+void avif_session_destroy(avif_session *s) {
+  if (s->codec_inited)
+    aom_codec_destroy(&s->codec);
+  free(s->stats.buf);
+  if (s->out.obus) {
+    for (int i = 0; i < s->count; i++)
+      free(s->out.obus[i].buf);
   }
+  free(s->out.obus);
+  free(s->out.keyframes);
+  free(s);
+}
 
-  // Pass 2.
-  aom_cfg.g_pass = AOM_RC_LAST_PASS;
-  aom_cfg.rc_twopass_stats_in = stats;
-  if ((res = init_codec(iface, &codec, &aom_cfg, cfg)))
-    goto fail;
-  if ((res = do_pass2(&codec, &aom_frame, obu)))
+// Copy decoded planes into the single buffer with the same layout as the
+// one passed to avif_session_add_frame.
+static avif_error copy_frame(const aom_image_t *img, avif_frame *frame) {
+  if (img->d_w > UINT16_MAX || img->d_h > UINT16_MAX)
+    return AVIF_ERROR_UNSUPPORTED;
+  if (img->monochrome) {
+    frame->subsampling = AVIF_SUBSAMPLING_I400;
+  } else {
+    switch (img->fmt & ~AOM_IMG_FMT_HIGHBITDEPTH) {
+    case AOM_IMG_FMT_I420:
+      frame->subsampling = AVIF_SUBSAMPLING_I420;
+      break;
+    case AOM_IMG_FMT_I422:
+      frame->subsampling = AVIF_SUBSAMPLING_I422;
+      break;
+    case AOM_IMG_FMT_I444:
+      frame->subsampling = AVIF_SUBSAMPLING_I444;
+      break;
+    default:
+      return AVIF_ERROR_UNSUPPORTED;
+    }
+  }
+  frame->width = img->d_w;
+  frame->height = img->d_h;
+  frame->bit_depth = img->bit_depth;
+
+  avif_format fmt = convert_subsampling(frame->subsampling, frame->bit_depth);
+  // libaom may output 8-bit samples in 16-bit buffer.
+  int src_bytes = (img->fmt & AOM_IMG_FMT_HIGHBITDEPTH) ? 2 : 1;
+  int dst_bytes = fmt.bytes_per_sample;
+  int num_planes = fmt.monochrome ? 1 : 3;
+  size_t sz = 0;
+  for (int plane = 0; plane < num_planes; plane++) {
+    int w = plane ? (frame->width + img->x_chroma_shift) >> img->x_chroma_shift
+                  : frame->width;
+    int h = plane ? (frame->height + img->y_chroma_shift) >> img->y_chroma_shift
+                  : frame->height;
+    sz += (size_t)w * h * dst_bytes;
+  }
+  frame->data = malloc(sz);
+  if (!frame->data)
+    return AVIF_ERROR_NO_MEMORY;
+
+  uint8_t *dst = frame->data;
+  for (int plane = 0; plane < num_planes; plane++) {
+    int w = plane ? (frame->width + img->x_chroma_shift) >> img->x_chroma_shift
+                  : frame->width;
+    int h = plane ? (frame->height + img->y_chroma_shift) >> img->y_chroma_shift
+                  : frame->height;
+    for (int y = 0; y < h; y++) {
+      const uint8_t *src = img->planes[plane] + y * img->stride[plane];
+      if (src_bytes == dst_bytes) {
+        memcpy(dst, src, w * dst_bytes);
+      } else {
+        const uint16_t *src16 = (const uint16_t *)src;
+        for (int x = 0; x < w; x++)
+          dst[x] = src16[x];
+      }
+      dst += w * dst_bytes;
+    }
+  }
+  return AVIF_OK;
+}
+
+avif_error avif_decode_frame(int threads,
+                             const avif_buffer *obu,
+                             avif_frame *frame,
+                             avif_color_config *color) {
+  // Validation.
+  assert(threads >= 1);
+
+  avif_error res = AVIF_OK;
+  aom_codec_ctx_t codec;
+  aom_codec_iface_t *iface = aom_codec_av1_dx();
+  aom_codec_dec_cfg_t aom_cfg = { 0 };
+  aom_cfg.threads = threads;
+  aom_cfg.allow_lowbitdepth = 1;
+  if (aom_codec_dec_init(&codec, iface, &aom_cfg, 0))
+    return AVIF_ERROR_CODEC_INIT;
+
+  if (aom_codec_decode(&codec, obu->buf, obu->sz, NULL)) {
+    res = AVIF_ERROR_FRAME_DECODE;
     goto fail;
-  if (aom_codec_destroy(&codec)) {
-    res = AVIF_ERROR_CODEC_DESTROY;
+  }
+  aom_codec_iter_t iter = NULL;
+  aom_image_t *img = aom_codec_get_frame(&codec, &iter);
+  if (!img) {
+    res = AVIF_ERROR_FRAME_DECODE;
     goto fail;
   }
+  color->matrix_coefficients = img->mc;
+  color->full_range = img->range == AOM_CR_FULL_RANGE;
+  color->chroma_sample_position = img->csp;
+  res = copy_frame(img, frame);
 
 fail:
-  free(stats.buf);
+  if (aom_codec_destroy(&codec) && !res)
+    res = AVIF_ERROR_CODEC_DESTROY;
   return res;
 }
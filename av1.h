@@ -7,6 +7,14 @@ enum {
   AVIF_MAX_SPEED = 8,
   AVIF_MIN_QUALITY = 0,
   AVIF_MAX_QUALITY = 63,
+  AVIF_MAX_SHARPNESS = 7,
+  AVIF_MODE_DEFAULT = -1,
+  AVIF_MAX_AQ_MODE = 3,
+  AVIF_DELTAQ_OBJECTIVE = 1,
+  AVIF_MAX_DELTAQ_MODE = 2,
+  AVIF_MAX_DENOISE_LEVEL = 50,
+  AVIF_TILES_AUTO = -1,
+  AVIF_MAX_TILES_LOG2 = 6,
 };
 
 typedef enum {
@@ -15,30 +23,111 @@ typedef enum {
   AVIF_ERROR_CODEC_INIT,
   AVIF_ERROR_CODEC_DESTROY,
   AVIF_ERROR_FRAME_ENCODE,
+  AVIF_ERROR_NO_MEMORY,
+  AVIF_ERROR_FRAME_DECODE,
+  AVIF_ERROR_UNSUPPORTED,
+  AVIF_ERROR_CANCELED,
 } avif_error;
 
 typedef enum {
   AVIF_SUBSAMPLING_I420,
+  AVIF_SUBSAMPLING_I422,
+  AVIF_SUBSAMPLING_I444,
+  AVIF_SUBSAMPLING_I400,
 } avif_subsampling;
 
+typedef enum {
+  AVIF_TUNE_PSNR,
+  AVIF_TUNE_SSIM,
+} avif_tune;
+
 typedef struct {
   int threads;
+  // Either 1 or 2, the first pass collects statistics for the second.
+  int passes;
   int speed;
   int quality;
+  int full_range;
+  int color_primaries;
+  int transfer_characteristics;
+  int matrix_coefficients;
+  int chroma_sample_position;
+  avif_tune tune;
+  int sharpness;
+  // Modes are passed to libaom as is, AVIF_MODE_DEFAULT keeps its
+  // default.
+  int aq_mode;
+  int deltaq_mode;
+  int chroma_deltaq;
+  // Bounds of the quantizer of lossy coding.
+  int min_quantizer;
+  int max_quantizer;
+  int enable_qm;
+  // Denoising with film grain synthesis, 0 disables it.
+  int denoise_level;
+  // Log2 of number of tiles, AVIF_TILES_AUTO picks it from frame size
+  // and threads.
+  int tile_rows_log2;
+  int tile_cols_log2;
+  // Single frame is coded as still picture with reduced sequence header.
+  int still_picture;
+  // Encoding is aborted once it's set to non-zero, may be NULL.
+  int *canceled;
 } avif_config;
 
 typedef struct {
   uint16_t width;
   uint16_t height;
   avif_subsampling subsampling;
+  uint8_t bit_depth;
   uint8_t *data;
 } avif_frame;
 
+typedef struct {
+  int matrix_coefficients;
+  int chroma_sample_position;
+  int full_range;
+} avif_color_config;
+
 typedef struct {
   void *buf;
   size_t sz;
 } avif_buffer;
 
-avif_error avif_encode_frame(const avif_config *cfg,
-                             const avif_frame *frame,
-                             avif_buffer *obu);
+// An avif_session encodes frames of the same format and size which are
+// fed one by one, so they don't need to be kept in memory. Every pass
+// takes all frames in order, the first of two passes only collects
+// statistics for the second.
+typedef struct avif_session avif_session;
+
+// Create session encoding count frames of the format of the given frame,
+// its data is not used. Duration of each frame is in 1/timescale
+// seconds.
+avif_error avif_session_create(const avif_config *cfg,
+                               const avif_frame *format,
+                               int count,
+                               int timescale,
+                               avif_session **session);
+
+avif_error avif_session_begin_pass(avif_session *s);
+
+// Frame data may be reused once the call returns.
+avif_error avif_session_add_frame(avif_session *s,
+                                  const avif_frame *frame,
+                                  int duration);
+
+avif_error avif_session_end_pass(avif_session *s);
+
+// Move temporal unit of the i-th frame to obu after the last pass and
+// store its key frame flag. Buffer must be freed by the caller.
+void avif_session_take_frame(avif_session *s,
+                             int i,
+                             avif_buffer *obu,
+                             int *keyframe);
+
+void avif_session_destroy(avif_session *s);
+
+avif_error avif_decode_frame(int threads,
+                             const avif_buffer *obu,
+                             avif_frame *frame,
+                             avif_color_config *color);
@@ -1,4 +1,4 @@
-// Package avif implements a AVIF image encoder.
+// Package avif implements a AVIF image encoder and decoder.
 //
 // The AVIF specification is at https://aomediacodec.github.io/av1-avif/.
 package avif
@@ -9,10 +9,14 @@ package avif
 // #include "av1.h"
 import "C"
 import (
+	"context"
 	"fmt"
 	"image"
 	"io"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
 )
 
 // Encoder constants.
@@ -23,26 +27,245 @@ const (
 	MaxSpeed   = 8
 	MinQuality = 0
 	MaxQuality = 63
+	// Encoder tuning.
+	MinSharpness    = 0
+	MaxSharpness    = 7
+	MinDenoiseLevel = 0
+	MaxDenoiseLevel = 50
+	// Tiles of the AV1 frame.
+	TilesAuto    = 0
+	TilesSingle  = -1
+	MinTilesLog2 = 1
+	MaxTilesLog2 = 6
+	// Tiles of the grid image.
+	MinGridTileSize = 64
+	MaxGridTileSize = 65535
+	maxGridTiles    = 256 // per dimension
 )
 
 // Options are the encoding parameters. Threads ranges from MinThreads
 // to MaxThreads, 0 means use all available cores. Speed ranges from
 // MinSpeed to MaxSpeed. Quality ranges from MinQuality to MaxQuality,
 // lower is better, 0 means lossless encoding. SubsampleRatio specifies
-// subsampling of the encoded image, nil means 4:2:0.
+// subsampling of the encoded image, nil means 4:2:0. BitDepth is the
+// number of bits per sample of the encoded image, either 8, 10 or 12, 0
+// means 8. AlphaQuality is the same as Quality but for alpha channel,
+// it's only used if image has non-opaque pixels. Monochrome forces
+// encoding of luma plane only, it's always enabled for *image.Gray and
+// *image.Gray16 images. RawYCbCr makes planes of *image.YCbCr images with
+// the same subsample ratio to be copied as is and signaled as BT.601 full
+// range, like in JPEG, instead of converting them with the specified
+// matrix and range. ChromaFilter is the filter used to downsample chroma
+// planes, LinearLight makes filtering to be performed in linear light
+// assuming sRGB input. MatrixCoefficients is the matrix used to convert
+// RGB to YCbCr, FullRange makes samples to use full range of values
+// instead of the limited (studio) one. ICCProfile is the colour profile
+// of the image, sRGB is assumed if it's not set. Exif and XMP are the
+// metadata stored along with the image, Exif is in TIFF format possibly
+// prefixed by "Exif\0\0" header. CleanAperture (in image coordinates,
+// must start at chroma sample), Rotation (anti-clockwise, in degrees) and
+// Mirror are the transformations viewers apply to display the image,
+// pixels are stored as is. GridTileWidth and GridTileHeight range from
+// MinGridTileSize to MaxGridTileSize and make the image to be split into
+// tiles of the grid which are encoded concurrently, 0 means the whole
+// dimension unless it exceeds MaxGridTileSize, in which case it's split
+// into equal tiles. Tile size must be even in subsampled dimension.
+// LoopCount controls repetition of image sequences like in
+// image/gif.GIF: 0 means loop forever, -1 means play once, otherwise the
+// sequence is played LoopCount+1 times. Tune is the metric the encoder
+// optimizes for. Sharpness ranges from MinSharpness to MaxSharpness,
+// higher values preserve more edges and texture. AQMode and DeltaQMode
+// control adaptive quantization within frame, default modes leave the
+// ones of libaom. ChromaDeltaQ makes chroma quantizers to be adjusted
+// too, encoding fails with EncoderError if libaom is too old to support
+// it. MinQuantizer and MaxQuantizer range from MinQuality to MaxQuality
+// and bound the quantizers of lossy coding, the requested quality is
+// clamped to them. 0 MaxQuantizer means it's unset and MaxQuality is
+// used, so the upper bound can't be 0.
+// QuantizationMatrices enables frequency dependent quantization.
+// DenoiseLevel ranges from MinDenoiseLevel to MaxDenoiseLevel, the noise
+// of the image is removed before encoding and synthesized back by the
+// decoder as film grain of the given strength, 0 disables denoising.
+// Denoising isn't applied to alpha channel. TileRowsLog2 and
+// TileColsLog2 range from MinTilesLog2 to MaxTilesLog2 and set the number
+// of independently decodable tiles of AV1 frames, 0 means TilesAuto which
+// picks it from the frame size and threads so that large images are
+// decoded in parallel while small ones are coded as a single tile.
+// TilesSingle requests a single tile, i.e. log2 of 0. Passes is the number of
+// encoding passes, either 1 or 2, 0 means 2. The first pass only gathers
+// statistics for the second, single pass is faster and loses little for
+// still images.
 type Options struct {
-	Threads        int
-	Speed          int
-	Quality        int
-	SubsampleRatio *image.YCbCrSubsampleRatio
+	Threads              int
+	Speed                int
+	Quality              int
+	SubsampleRatio       *image.YCbCrSubsampleRatio
+	BitDepth             int
+	AlphaQuality         int
+	Monochrome           bool
+	RawYCbCr             bool
+	ChromaFilter         ChromaFilter
+	LinearLight          bool
+	MatrixCoefficients   MatrixCoefficients
+	FullRange            bool
+	ICCProfile           []byte
+	Exif                 []byte
+	XMP                  []byte
+	CleanAperture        image.Rectangle
+	Rotation             int
+	Mirror               Mirror
+	GridTileWidth        int
+	GridTileHeight       int
+	LoopCount            int
+	Tune                 Tune
+	Sharpness            int
+	AQMode               AQMode
+	DeltaQMode           DeltaQMode
+	ChromaDeltaQ         bool
+	MinQuantizer         int
+	MaxQuantizer         int
+	QuantizationMatrices bool
+	DenoiseLevel         int
+	TileRowsLog2         int
+	TileColsLog2         int
+	Passes               int
 }
 
 // DefaultOptions defines default encoder config.
 var DefaultOptions = Options{
-	Threads:        0,
-	Speed:          4,
-	Quality:        25,
-	SubsampleRatio: nil,
+	Threads:              0,
+	Speed:                4,
+	Quality:              25,
+	SubsampleRatio:       nil,
+	BitDepth:             8,
+	AlphaQuality:         0,
+	Monochrome:           false,
+	RawYCbCr:             false,
+	ChromaFilter:         ChromaFilterBilinear,
+	LinearLight:          false,
+	MatrixCoefficients:   MatrixBT709,
+	FullRange:            false,
+	ICCProfile:           nil,
+	Exif:                 nil,
+	XMP:                  nil,
+	CleanAperture:        image.Rectangle{},
+	Rotation:             0,
+	Mirror:               MirrorNone,
+	GridTileWidth:        0,
+	GridTileHeight:       0,
+	LoopCount:            0,
+	Tune:                 TunePSNR,
+	Sharpness:            0,
+	AQMode:               AQModeDefault,
+	DeltaQMode:           DeltaQDefault,
+	ChromaDeltaQ:         false,
+	MinQuantizer:         MinQuality,
+	MaxQuantizer:         MaxQuality,
+	QuantizationMatrices: false,
+	DenoiseLevel:         0,
+	TileRowsLog2:         TilesAuto,
+	TileColsLog2:         TilesAuto,
+	Passes:               2,
+}
+
+// A ChromaFilter is the filter used to downsample chroma planes of the
+// subsampled image.
+type ChromaFilter int
+
+// Chroma filters. Chroma sample position is signaled in the file if
+// AV1 is able to describe it.
+const (
+	// Top-left sample of the block, co-sited with luma.
+	ChromaFilterPoint ChromaFilter = iota
+	// Average of the block, centered.
+	ChromaFilterBox
+	// Triangle filter, co-sited with luma horizontally and centered
+	// vertically (MPEG-2 style).
+	ChromaFilterBilinear
+	// Catmull-Rom cubic filter, sited as ChromaFilterBilinear.
+	ChromaFilterCatmullRom
+)
+
+// A MatrixCoefficients is the matrix used to convert RGB to YCbCr.
+type MatrixCoefficients int
+
+// Supported matrices.
+const (
+	MatrixBT709 MatrixCoefficients = iota
+	MatrixBT601
+	// BT.2020 non-constant luminance.
+	MatrixBT2020NCL
+	// RGB is stored as is in GBR order, requires 4:4:4 subsampling and
+	// implies full range. Can be used for true lossless encoding.
+	MatrixIdentity
+)
+
+// A Mirror is the mirroring of the image applied after rotation.
+type Mirror int
+
+// Supported mirrorings.
+const (
+	MirrorNone Mirror = iota
+	// Mirror about vertical axis, i.e. flip left and right.
+	MirrorVertical
+	// Mirror about horizontal axis, i.e. flip top and bottom.
+	MirrorHorizontal
+)
+
+// A Tune is the metric the encoder optimizes for.
+type Tune int
+
+// Supported metrics.
+const (
+	TunePSNR Tune = iota
+	TuneSSIM
+)
+
+// An AQMode is the adaptive quantization mode, it assigns quantizers to
+// segments of the frame.
+type AQMode int
+
+// Supported AQ modes.
+const (
+	// Mode of libaom is left as is.
+	AQModeDefault AQMode = iota
+	AQModeNone
+	// Lower quantizer in flat areas.
+	AQModeVariance
+	// Lower quantizer in complex areas.
+	AQModeComplexity
+	// Refresh quality of changed areas over frames.
+	AQModeCyclic
+)
+
+// A DeltaQMode is the mode of quantizer adjustment per superblock.
+type DeltaQMode int
+
+// Supported delta q modes.
+const (
+	// Mode of libaom is left as is.
+	DeltaQDefault DeltaQMode = iota
+	DeltaQNone
+	// Based on temporal dependency model, which stays enabled for still
+	// images with this mode only.
+	DeltaQObjective
+	DeltaQPerceptual
+)
+
+// Return mode value of libaom.
+func (m AQMode) code() C.int {
+	if m == AQModeDefault {
+		return C.AVIF_MODE_DEFAULT
+	}
+	return C.int(m - AQModeNone)
+}
+
+// Return mode value of libaom.
+func (m DeltaQMode) code() C.int {
+	if m == DeltaQDefault {
+		return C.AVIF_MODE_DEFAULT
+	}
+	return C.int(m - DeltaQNone)
 }
 
 // An OptionsError reports that the passed options are not valid.
@@ -65,6 +288,14 @@ func (e EncoderError) ToString() string {
 		return "codec destroy error"
 	case C.AVIF_ERROR_FRAME_ENCODE:
 		return "frame encode error"
+	case C.AVIF_ERROR_NO_MEMORY:
+		return "out of memory"
+	case C.AVIF_ERROR_FRAME_DECODE:
+		return "frame decode error"
+	case C.AVIF_ERROR_UNSUPPORTED:
+		return "unsupported format or option"
+	case C.AVIF_ERROR_CANCELED:
+		return "canceled"
 	default:
 		return "unknown error"
 	}
@@ -81,119 +312,1111 @@ func (e MuxerError) Error() string {
 	return fmt.Sprintf("muxer error: %s", string(e))
 }
 
-// RGB to BT.709 YCbCr limited range.
-// https://web.archive.org/web/20180421030430/http://www.equasys.de/colorconversion.html
-// TODO(Kagami): Use fixed point, don't calc chroma values for skipped pixels.
-func rgb2yuv(r16, g16, b16 uint32) (uint8, uint8, uint8) {
-	r, g, b := float32(r16)/256, float32(g16)/256, float32(b16)/256
-	y := 0.183*r + 0.614*g + 0.062*b + 16
-	cb := -0.101*r - 0.339*g + 0.439*b + 128
-	cr := 0.439*r - 0.399*g - 0.040*b + 128
-	return uint8(y), uint8(cb), uint8(cr)
+// A DecoderError reports that the decoder error has occured.
+type DecoderError int
+
+func (e DecoderError) Error() string {
+	return fmt.Sprintf("decoder error: %s", EncoderError(e).ToString())
 }
 
-// Encode writes the Image m to w in AVIF format with the given options.
-// Default parameters are used if a nil *Options is passed.
-//
-// NOTE: Image pixels are converted to RGBA first using standard Go
-// library. This is no-op for PNG images and does the right thing for
-// JPEG since they are normally stored as BT.601 full range with some
-// chroma subsampling. Then pixels are converted to BT.709 limited range
-// with specified chroma subsampling.
-//
-// Alpha channel and monochrome are not supported at the moment. Only
-// 4:2:0 8-bit images are supported at the moment.
-func Encode(w io.Writer, m image.Image, o *Options) error {
-	// TODO(Kagami): More subsamplings, 10/12 bitdepth, monochrome, alpha.
-	// TODO(Kagami): Allow to pass BT.709 YCbCr without extra conversions.
-	if o == nil {
-		o2 := DefaultOptions
-		o = &o2
+// A MetadataError reports that the metadata can't be extracted from the
+// source image.
+type MetadataError string
+
+func (e MetadataError) Error() string {
+	return fmt.Sprintf("metadata error: %s", string(e))
+}
+
+// A DemuxerError reports that the input is not a valid AVIF file or uses
+// unsupported features.
+type DemuxerError string
+
+func (e DemuxerError) Error() string {
+	return fmt.Sprintf("demuxer error: %s", string(e))
+}
+
+func unpremultiply(c, a uint32) uint32 {
+	c = c * 0xffff / a
+	if c > 0xffff {
+		c = 0xffff
+	}
+	return c
+}
+
+// A frameBuffer holds frame samples in C memory so it can be passed to
+// libaom. High bitdepth samples are stored as native 16-bit integers.
+type frameBuffer struct {
+	ptr      unsafe.Pointer
+	capacity int
+	depth    uint
+	data     []byte
+	data16   []uint16
+}
+
+func bytesPerSample(depth uint) int {
+	if depth > 8 {
+		return 2
+	}
+	return 1
+}
+
+func newFrameBuffer(size int, depth uint) *frameBuffer {
+	capacity := size * bytesPerSample(depth)
+	// Can't pass normal slice inside a struct, see
+	// https://github.com/golang/go/issues/14210
+	b := &frameBuffer{
+		ptr:      C.malloc(C.size_t(capacity)),
+		capacity: capacity,
+	}
+	b.reuse(size, depth)
+	return b
+}
+
+// reuse resizes the buffer in place if it has enough capacity.
+func (b *frameBuffer) reuse(size int, depth uint) bool {
+	if b == nil || size*bytesPerSample(depth) > b.capacity {
+		return false
+	}
+	b.depth = depth
+	b.data, b.data16 = nil, nil
+	if depth > 8 {
+		b.data16 = unsafe.Slice((*uint16)(b.ptr), size)
+	} else {
+		b.data = unsafe.Slice((*byte)(b.ptr), size)
+	}
+	return true
+}
+
+func (b *frameBuffer) put(pos int, v uint16) {
+	if b.depth > 8 {
+		b.data16[pos] = v
 	} else {
-		o2 := *o
-		o = &o2
+		b.data[pos] = uint8(v)
 	}
+}
+
+func (b *frameBuffer) fill(v uint16) {
+	if b.depth > 8 {
+		for i := range b.data16 {
+			b.data16[i] = v
+		}
+	} else {
+		for i := range b.data {
+			b.data[i] = uint8(v)
+		}
+	}
+}
+
+func (b *frameBuffer) free() {
+	C.free(b.ptr)
+}
+
+// Timescale of the still image, its duration doesn't matter.
+const stillTimescale = 24
+
+// Return temporal unit of the frame coded as still picture.
+func encodeStill(cfg C.avif_config, frame C.avif_frame) ([]byte, error) {
+	cfg.still_picture = 1
+	s, err := newEncodeSession(cfg, frame, 1, stillTimescale)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	for pass := 0; pass < int(cfg.passes); pass++ {
+		if err := s.beginPass(); err != nil {
+			return nil, err
+		}
+		if err := s.add(frame, 1); err != nil {
+			return nil, err
+		}
+		if err := s.endPass(); err != nil {
+			return nil, err
+		}
+	}
+	obuData, _, err := s.result()
+	if err != nil {
+		return nil, err
+	}
+	return obuData[0], nil
+}
+
+// An encodeSession encodes frames fed one by one, so they don't need to
+// be kept in memory. All frames are fed in order in each pass.
+type encodeSession struct {
+	s     *C.avif_session
+	count int
+}
+
+func newEncodeSession(cfg C.avif_config, format C.avif_frame, count, timescale int) (*encodeSession, error) {
+	var s *C.avif_session
+	// TODO(Kagami): Error description.
+	if eErr := C.avif_session_create(&cfg, &format, C.int(count), C.int(timescale), &s); eErr != 0 {
+		return nil, EncoderError(eErr)
+	}
+	return &encodeSession{s: s, count: count}, nil
+}
+
+func (s *encodeSession) beginPass() error {
+	if eErr := C.avif_session_begin_pass(s.s); eErr != 0 {
+		return EncoderError(eErr)
+	}
+	return nil
+}
+
+// Frame buffer may be reused once the call returns.
+func (s *encodeSession) add(frame C.avif_frame, duration int) error {
+	if eErr := C.avif_session_add_frame(s.s, &frame, C.int(duration)); eErr != 0 {
+		return EncoderError(eErr)
+	}
+	return nil
+}
+
+func (s *encodeSession) endPass() error {
+	if eErr := C.avif_session_end_pass(s.s); eErr != 0 {
+		return EncoderError(eErr)
+	}
+	return nil
+}
+
+// Return temporal units of the frames along with their key frame flags,
+// must be called after the last pass.
+func (s *encodeSession) result() (obuData [][]byte, keyframes []bool, err error) {
+	obuData = make([][]byte, s.count)
+	keyframes = make([]bool, s.count)
+	for i := range obuData {
+		var obu C.avif_buffer
+		var keyframe C.int
+		C.avif_session_take_frame(s.s, C.int(i), &obu, &keyframe)
+		data := C.GoBytes(obu.buf, C.int(obu.sz))
+		C.free(obu.buf)
+		if obuData[i], err = stripTemporalDelimiters(data); err != nil {
+			return nil, nil, err
+		}
+		keyframes[i] = keyframe != 0
+	}
+	return
+}
+
+func (s *encodeSession) close() {
+	C.avif_session_destroy(s.s)
+}
+
+// Run count jobs on the workers concurrently splitting threads between
+// them, each job gets index of its worker and its number of threads.
+// Remaining jobs are canceled on the first error.
+func runJobs(count, workers, threads int, canceled *C.int, job func(i, worker, threads int) error) error {
+	queue := make(chan int, count)
+	for i := 0; i < count; i++ {
+		queue <- i
+	}
+	close(queue)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+			atomic.StoreInt32((*int32)(unsafe.Pointer(canceled)), 1)
+		}
+		mu.Unlock()
+	}
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := range queue {
+				// Flag is also set once the context is done.
+				if atomic.LoadInt32((*int32)(unsafe.Pointer(canceled))) != 0 {
+					fail(EncoderError(C.AVIF_ERROR_CANCELED))
+					return
+				}
+				if err := job(i, worker, threads/workers); err != nil {
+					fail(err)
+					return
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// Return size of grid tiles for the image dimension. The whole dimension
+// is split into equal tiles if it's too large for a single frame.
+func gridTileSize(size, tile int, subsampled bool) int {
+	if tile != 0 && tile < size {
+		return tile
+	}
+	if size <= MaxGridTileSize {
+		return size
+	}
+	limit := MaxGridTileSize
+	if subsampled {
+		limit &^= 1
+	}
+	n := (size + limit - 1) / limit
+	tile = (size + n - 1) / n
+	if subsampled {
+		tile = (tile + 1) &^ 1
+	}
+	return tile
+}
+
+// watchContext sets the cancel flag checked by libaom encoding loop once
+// the context is done. Returned function stops watching, flag must not be
+// freed before that.
+func watchContext(ctx context.Context, canceled *C.int) (stop func()) {
+	done := ctx.Done()
+	if done == nil {
+		return func() {}
+	}
+	stopc := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-done:
+			atomic.StoreInt32((*int32)(unsafe.Pointer(canceled)), 1)
+		case <-stopc:
+		}
+	}()
+	return func() {
+		close(stopc)
+		<-exited
+	}
+}
+
+// Replace cancellation error of the encoder with the context one.
+func contextError(ctx context.Context, err error) error {
+	if err == EncoderError(C.AVIF_ERROR_CANCELED) {
+		return ctx.Err()
+	}
+	return err
+}
+
+// An Encoder encodes images with the fixed options. Options are
+// validated once and scratch buffers are reused between calls, so it's
+// cheaper than Encode when many images are encoded with the same
+// settings.
+//
+// Encoder is not safe for concurrent use, create one per goroutine
+// instead. Close must be called to release the buffers.
+type Encoder struct {
+	opts        Options
+	subsampling C.avif_subsampling
+	// Scratch buffers of the workers, see buffers.
+	color []*frameBuffer
+	alpha []*frameBuffer
+}
+
+// NewEncoder returns a new Encoder with the given options. Default
+// parameters are used if a nil *Options is passed.
+func NewEncoder(o *Options) (*Encoder, error) {
+	e := &Encoder{opts: DefaultOptions}
+	if o != nil {
+		e.opts = *o
+	}
+	o = &e.opts
 	if o.Threads == 0 {
 		o.Threads = runtime.NumCPU()
 		if o.Threads > MaxThreads {
 			o.Threads = MaxThreads
 		}
 	}
-	if o.SubsampleRatio == nil {
+	if o.BitDepth == 0 {
+		o.BitDepth = 8
+	}
+	if o.Passes == 0 {
+		o.Passes = 2
+	}
+	if o.SubsampleRatio == nil || o.Monochrome {
+		// Monochrome is signaled as 4:2:0 in AV1.
 		s := image.YCbCrSubsampleRatio420
 		o.SubsampleRatio = &s
 		// if yuvImg, ok := m.(*image.YCbCr); ok {
 		// 	o.SubsampleRatio = &yuvImg.SubsampleRatio
 		// }
+	} else {
+		s := *o.SubsampleRatio
+		o.SubsampleRatio = &s
 	}
 	if o.Threads < MinThreads || o.Threads > MaxThreads {
-		return OptionsError("bad threads number")
+		return nil, OptionsError("bad threads number")
 	}
 	if o.Speed < MinSpeed || o.Speed > MaxSpeed {
-		return OptionsError("bad speed value")
+		return nil, OptionsError("bad speed value")
 	}
 	if o.Quality < MinQuality || o.Quality > MaxQuality {
-		return OptionsError("bad quality value")
+		return nil, OptionsError("bad quality value")
+	}
+	if o.AlphaQuality < MinQuality || o.AlphaQuality > MaxQuality {
+		return nil, OptionsError("bad alpha quality value")
+	}
+	if o.ChromaFilter < ChromaFilterPoint || o.ChromaFilter > ChromaFilterCatmullRom {
+		return nil, OptionsError("bad chroma filter")
+	}
+	if o.MatrixCoefficients < MatrixBT709 || o.MatrixCoefficients > MatrixIdentity {
+		return nil, OptionsError("bad matrix coefficients")
+	}
+	if o.MatrixCoefficients == MatrixIdentity && !o.Monochrome &&
+		*o.SubsampleRatio != image.YCbCrSubsampleRatio444 {
+		return nil, OptionsError("identity matrix requires 4:4:4 subsampling")
+	}
+	switch *o.SubsampleRatio {
+	case image.YCbCrSubsampleRatio420:
+		e.subsampling = C.AVIF_SUBSAMPLING_I420
+	case image.YCbCrSubsampleRatio422:
+		e.subsampling = C.AVIF_SUBSAMPLING_I422
+	case image.YCbCrSubsampleRatio444:
+		e.subsampling = C.AVIF_SUBSAMPLING_I444
+	default:
+		return nil, OptionsError("unsupported subsampling")
+	}
+	if o.BitDepth != 8 && o.BitDepth != 10 && o.BitDepth != 12 {
+		return nil, OptionsError("unsupported bit depth")
+	}
+	if o.Rotation != 0 && o.Rotation != 90 && o.Rotation != 180 && o.Rotation != 270 {
+		return nil, OptionsError("bad rotation")
+	}
+	if o.Mirror < MirrorNone || o.Mirror > MirrorHorizontal {
+		return nil, OptionsError("bad mirror")
+	}
+	for _, size := range []int{o.GridTileWidth, o.GridTileHeight} {
+		if size != 0 && (size < MinGridTileSize || size > MaxGridTileSize) {
+			return nil, OptionsError("bad grid tile size")
+		}
+	}
+	if o.LoopCount < -1 {
+		return nil, OptionsError("bad loop count")
+	}
+	if o.Tune < TunePSNR || o.Tune > TuneSSIM {
+		return nil, OptionsError("bad tune")
+	}
+	if o.Sharpness < MinSharpness || o.Sharpness > MaxSharpness {
+		return nil, OptionsError("bad sharpness")
+	}
+	if o.AQMode < AQModeDefault || o.AQMode > AQModeCyclic {
+		return nil, OptionsError("bad AQ mode")
+	}
+	if o.DeltaQMode < DeltaQDefault || o.DeltaQMode > DeltaQPerceptual {
+		return nil, OptionsError("bad delta q mode")
+	}
+	if o.MaxQuantizer == 0 {
+		o.MaxQuantizer = MaxQuality
+	}
+	if o.MinQuantizer < MinQuality || o.MaxQuantizer > MaxQuality ||
+		o.MinQuantizer > o.MaxQuantizer {
+		return nil, OptionsError("bad quantizer range")
+	}
+	if o.DenoiseLevel < MinDenoiseLevel || o.DenoiseLevel > MaxDenoiseLevel {
+		return nil, OptionsError("bad denoise level")
+	}
+	for _, n := range []int{o.TileRowsLog2, o.TileColsLog2} {
+		if n != TilesAuto && n != TilesSingle && (n < MinTilesLog2 || n > MaxTilesLog2) {
+			return nil, OptionsError("bad number of tiles")
+		}
+	}
+	if o.Passes != 1 && o.Passes != 2 {
+		return nil, OptionsError("bad number of passes")
+	}
+	return e, nil
+}
+
+// Close releases scratch buffers of the encoder.
+func (e *Encoder) Close() {
+	for _, b := range append(e.color, e.alpha...) {
+		if b != nil {
+			b.free()
+		}
+	}
+	e.color, e.alpha = nil, nil
+}
+
+// Make slots of scratch buffers for the number of workers, buffers
+// themselves are allocated on demand.
+func (e *Encoder) buffers(workers int) {
+	for len(e.color) < workers {
+		e.color = append(e.color, nil)
+		e.alpha = append(e.alpha, nil)
 	}
-	if *o.SubsampleRatio != image.YCbCrSubsampleRatio420 {
-		return OptionsError("unsupported subsampling")
+}
+
+// Return scratch buffer of the given size, reallocating it if needed.
+func (e *Encoder) buffer(b **frameBuffer, size int, depth uint) *frameBuffer {
+	if !(*b).reuse(size, depth) {
+		if *b != nil {
+			(*b).free()
+		}
+		*b = newFrameBuffer(size, depth)
+	}
+	return *b
+}
+
+// A frameFormat is the format of encoded frames derived from the
+// encoder options and the source images.
+type frameFormat struct {
+	opts         Options
+	subsampling  C.avif_subsampling
+	xMask, yMask int
+	depth        uint
+	color        colorConfig
+	chromaPos    uint8
+	raw          bool // planes of *image.YCbCr are copied as is
+	matrix       *yuvMatrix
+	chroma       *chromaSampler // point sampling if not set
+}
+
+// Return whether the image is grayscale and whether its planes can be
+// copied as is.
+func (e *Encoder) sourceKind(m image.Image) (gray, raw bool) {
+	switch m := m.(type) {
+	case *image.Gray, *image.Gray16:
+		gray = true
+	case *image.YCbCr:
+		raw = e.opts.RawYCbCr && m.SubsampleRatio == *e.opts.SubsampleRatio
+	}
+	return
+}
+
+// Return format of frames encoding images of the given kind, see
+// sourceKind.
+func (e *Encoder) frameFormat(gray, raw bool) *frameFormat {
+	f := &frameFormat{opts: e.opts, subsampling: e.subsampling}
+	o := &f.opts
+	if gray {
+		o.Monochrome = true
+	}
+	if o.Monochrome {
+		s := image.YCbCrSubsampleRatio420
+		o.SubsampleRatio = &s
+		f.subsampling = C.AVIF_SUBSAMPLING_I400
+	}
+	sx, sy := getSubsamplingXY(*o.SubsampleRatio)
+	if sx && !o.Monochrome {
+		f.xMask = 1
+	}
+	if sy && !o.Monochrome {
+		f.yMask = 1
+	}
+	f.depth = uint(o.BitDepth)
+
+	mc := o.MatrixCoefficients
+	if o.Monochrome && mc == MatrixIdentity {
+		// Identity isn't allowed for subsampled image, luma is the same
+		// for any matrix anyway.
+		mc = MatrixBT709
+	}
+	if mc == MatrixIdentity {
+		// AV1 implies full range for sRGB stored as is.
+		o.FullRange = true
+	}
+	// Go images are assumed to be sRGB unless profile is provided.
+	f.color = colorConfig{
+		colorPrimaries:          cpBT709,
+		transferCharacteristics: tcSRGB,
+		matrixCoefficients:      mc.codePoint(),
+		fullRange:               o.FullRange,
+	}
+	if len(o.ICCProfile) != 0 {
+		f.color.colorPrimaries = cpUnspecified
+		f.color.transferCharacteristics = tcUnspecified
+		f.color.iccProfile = o.ICCProfile
+	}
+	f.chromaPos = cspUnknown
+	if raw && !o.Monochrome {
+		f.raw = true
+		f.color.matrixCoefficients = mcBT601
+		f.color.fullRange = true
+		return f
+	}
+	f.matrix = newYUVMatrix(mc, o.FullRange, f.depth)
+	if (sx || sy) && !o.Monochrome && o.ChromaFilter != ChromaFilterPoint {
+		f.chroma = newChromaSampler(o.ChromaFilter, o.LinearLight, sx, sy)
+	}
+	// Position is only signaled for 4:2:0.
+	if sx && sy && !o.Monochrome {
+		f.chromaPos = chromaSamplePosition(o.ChromaFilter)
+	}
+	return f
+}
+
+// Return number of luma and chroma samples per plane of the frame.
+func (f *frameFormat) planeSizes(width, height int) (ySize, uSize int) {
+	ySize = width * height
+	if !f.opts.Monochrome {
+		uSize = ((width + f.xMask) >> uint(f.xMask)) * ((height + f.yMask) >> uint(f.yMask))
+	}
+	return
+}
+
+// Return clean aperture relative to the image bounds.
+func (f *frameFormat) cleanAperture(rec image.Rectangle) (image.Rectangle, error) {
+	clap := f.opts.CleanAperture.Sub(rec.Min)
+	if !f.opts.CleanAperture.Empty() &&
+		!validCleanAperture(clap, rec.Dx(), rec.Dy(), f.xMask != 0, f.yMask != 0) {
+		return clap, OptionsError("bad clean aperture")
+	}
+	return clap, nil
+}
+
+// Convert the region of the image into color and alpha frames with the
+// given number of threads, edge pixels are replicated outside of the
+// image. Returns whether all pixels are opaque, alpha may be nil to only
+// check that.
+func (f *frameFormat) convert(m image.Image, rec image.Rectangle, color, alpha *frameBuffer, threads int) bool {
+	if f.raw {
+		copyYCbCr(m.(*image.YCbCr), rec, color, f.xMask, f.yMask)
+		return true
+	}
+	ySize, uSize := f.planeSizes(rec.Dx(), rec.Dy())
+	c := &converter{
+		read:   newRowReader(m),
+		rec:    rec,
+		matrix: f.matrix,
+		xMask:  f.xMask,
+		yMask:  f.yMask,
+		ySize:  ySize,
+		uSize:  uSize,
+		color:  color,
+		alpha:  alpha,
+		chroma: f.chroma,
+	}
+	if !rec.In(m.Bounds()) {
+		c.read = clampedRowReader(c.read, m.Bounds())
+	}
+	return c.convert(threads)
+}
+
+// Return log2 of number of tiles passed to libaom.
+func tilesLog2(n int) C.int {
+	switch n {
+	case TilesAuto:
+		return C.AVIF_TILES_AUTO
+	case TilesSingle:
+		return 0
+	}
+	return C.int(n)
+}
+
+// Return encoder configs of color and alpha frames.
+func (f *frameFormat) configs(canceled *C.int) (color, alpha C.avif_config) {
+	color = C.avif_config{
+		passes:                   C.int(f.opts.Passes),
+		speed:                    C.int(f.opts.Speed),
+		quality:                  C.int(f.opts.Quality),
+		color_primaries:          C.int(f.color.colorPrimaries),
+		transfer_characteristics: C.int(f.color.transferCharacteristics),
+		matrix_coefficients:      C.int(f.color.matrixCoefficients),
+		chroma_sample_position:   C.int(f.chromaPos),
+		tune:                     C.AVIF_TUNE_PSNR,
+		sharpness:                C.int(f.opts.Sharpness),
+		aq_mode:                  f.opts.AQMode.code(),
+		deltaq_mode:              f.opts.DeltaQMode.code(),
+		min_quantizer:            C.int(f.opts.MinQuantizer),
+		max_quantizer:            C.int(f.opts.MaxQuantizer),
+		denoise_level:            C.int(f.opts.DenoiseLevel),
+		tile_rows_log2:           tilesLog2(f.opts.TileRowsLog2),
+		tile_cols_log2:           tilesLog2(f.opts.TileColsLog2),
+		canceled:                 canceled,
+	}
+	if f.color.fullRange {
+		color.full_range = 1
+	}
+	if f.opts.Tune == TuneSSIM {
+		color.tune = C.AVIF_TUNE_SSIM
+	}
+	if f.opts.ChromaDeltaQ {
+		color.chroma_deltaq = 1
+	}
+	if f.opts.QuantizationMatrices {
+		color.enable_qm = 1
+	}
+	// Alpha is always full range.
+	alpha = color
+	alpha.quality = C.int(f.opts.AlphaQuality)
+	alpha.full_range = 1
+	alpha.matrix_coefficients = mcUnspecified
+	alpha.chroma_sample_position = cspUnknown
+	alpha.denoise_level = 0
+	return
+}
+
+// Return color or alpha frame of the given size stored in the buffer.
+func (f *frameFormat) frame(width, height int, b *frameBuffer, alpha bool) C.avif_frame {
+	frame := C.avif_frame{
+		width:       C.uint16_t(width),
+		height:      C.uint16_t(height),
+		subsampling: f.subsampling,
+		bit_depth:   C.uint8_t(f.depth),
+		data:        (*C.uint8_t)(b.ptr),
+	}
+	if alpha {
+		frame.subsampling = C.AVIF_SUBSAMPLING_I400
+	}
+	return frame
+}
+
+// Return description of coded color or alpha image of the given size.
+func (f *frameFormat) codedImage(width, height int, alpha bool) *av1Image {
+	if alpha {
+		return &av1Image{
+			width:       uint32(width),
+			height:      uint32(height),
+			subsampling: image.YCbCrSubsampleRatio420,
+			depth:       f.opts.BitDepth,
+			monochrome:  true,
+		}
+	}
+	return &av1Image{
+		width:       uint32(width),
+		height:      uint32(height),
+		subsampling: *f.opts.SubsampleRatio,
+		depth:       f.opts.BitDepth,
+		monochrome:  f.opts.Monochrome,
+		chromaPos:   f.chromaPos,
+		color:       &f.color,
+		rotation:    uint8(f.opts.Rotation / 90),
+		mirror:      f.opts.Mirror,
+	}
+}
+
+// Encode writes the Image m to w in AVIF format with the given options.
+// Default parameters are used if a nil *Options is passed.
+//
+// NOTE: Image pixels are converted to RGBA first using standard Go
+// library. This is no-op for PNG images and does the right thing for
+// JPEG since they are normally stored as BT.601 full range with some
+// chroma subsampling. Then pixels are converted to YCbCr with specified
+// matrix, range and chroma subsampling.
+//
+// Alpha channel is encoded as a separate auxiliary image if image has
+// non-opaque pixels.
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	e, err := NewEncoder(o)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+	return e.Encode(w, m)
+}
+
+// EncodeContext is like Encode but aborts encoding once the context is
+// done. The context error is returned in that case.
+func EncodeContext(ctx context.Context, w io.Writer, m image.Image, o *Options) error {
+	e, err := NewEncoder(o)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+	return e.EncodeContext(ctx, w, m)
+}
+
+// Encode writes the Image m to w in AVIF format with the encoder
+// options. See package-level Encode for the details.
+func (e *Encoder) Encode(w io.Writer, m image.Image) error {
+	return e.EncodeContext(context.Background(), w, m)
+}
+
+// EncodeContext is like Encode but aborts encoding once the context is
+// done. The context error is returned in that case.
+func (e *Encoder) EncodeContext(ctx context.Context, w io.Writer, m image.Image) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 	if m.Bounds().Empty() {
 		return OptionsError("empty image")
 	}
+	f := e.frameFormat(e.sourceKind(m))
+	o := &f.opts
 
 	rec := m.Bounds()
 	width := rec.Max.X - rec.Min.X
 	height := rec.Max.Y - rec.Min.Y
-	ySize := width * height
-	uSize := ((width + 1) / 2) * ((height + 1) / 2)
-	dataSize := ySize + uSize*2
-	// Can't pass normal slice inside a struct, see
-	// https://github.com/golang/go/issues/14210
-	dataPtr := C.malloc(C.size_t(dataSize))
-	defer C.free(dataPtr)
-	data := (*[1 << 30]byte)(dataPtr)[:dataSize:dataSize]
-
-	yPos := 0
-	uPos := ySize
-	for j := rec.Min.Y; j < rec.Max.Y; j++ {
-		for i := rec.Min.X; i < rec.Max.X; i++ {
-			r16, g16, b16, _ := m.At(i, j).RGBA()
-			y, u, v := rgb2yuv(r16, g16, b16)
-			data[yPos] = y
-			yPos++
-			// TODO(Kagami): Resample chroma planes with some better filter.
-			if (i-rec.Min.X)&1 == 0 && (j-rec.Min.Y)&1 == 0 {
-				data[uPos] = u
-				data[uPos+uSize] = v
-				uPos++
+	xMask, yMask := f.xMask, f.yMask
+	clap, err := f.cleanAperture(rec)
+	if err != nil {
+		return err
+	}
+
+	// Image is split into tiles of the grid if it's needed, tiles at the
+	// right and bottom edges are padded.
+	tileWidth := gridTileSize(width, o.GridTileWidth, xMask != 0)
+	tileHeight := gridTileSize(height, o.GridTileHeight, yMask != 0)
+	columns := (width + tileWidth - 1) / tileWidth
+	rows := (height + tileHeight - 1) / tileHeight
+	if columns > 1 && tileWidth&xMask != 0 || rows > 1 && tileHeight&yMask != 0 {
+		return OptionsError("grid tile size must be even in subsampled dimension")
+	}
+	if columns > maxGridTiles || rows > maxGridTiles {
+		return OptionsError("too many grid tiles")
+	}
+	var tiles []image.Rectangle
+	for j := 0; j < rows; j++ {
+		for i := 0; i < columns; i++ {
+			x, y := rec.Min.X+i*tileWidth, rec.Min.Y+j*tileHeight
+			tiles = append(tiles, image.Rect(x, y, x+tileWidth, y+tileHeight))
+		}
+	}
+
+	canceled := (*C.int)(C.calloc(1, C.sizeof_int))
+	defer C.free(unsafe.Pointer(canceled))
+	stop := watchContext(ctx, canceled)
+	defer stop()
+
+	// Tiles are converted and encoded by the workers one at a time, so
+	// only the tiles being encoded are kept in memory. Alpha of a tile is
+	// only converted if it has non-opaque pixels.
+	workers := len(tiles)
+	if workers > o.Threads {
+		workers = o.Threads
+	}
+	e.buffers(workers)
+	ySize, uSize := f.planeSizes(tileWidth, tileHeight)
+	cfg, alphaCfg := f.configs(canceled)
+	colorData := make([][]byte, len(tiles))
+	alphaData := make([][]byte, len(tiles))
+	err = runJobs(len(tiles), workers, o.Threads, canceled, func(i, worker, threads int) error {
+		color := e.buffer(&e.color[worker], ySize+uSize*2, f.depth)
+		var alpha *frameBuffer
+		if !f.convert(m, tiles[i], color, nil, threads) {
+			alpha = e.buffer(&e.alpha[worker], ySize, f.depth)
+			f.convert(m, tiles[i], color, alpha, threads)
+		}
+		cfg, alphaCfg := cfg, alphaCfg
+		cfg.threads = C.int(threads)
+		alphaCfg.threads = C.int(threads)
+		var err error
+		if colorData[i], err = encodeStill(cfg, f.frame(tileWidth, tileHeight, color, false)); err != nil {
+			return err
+		}
+		if alpha != nil {
+			alphaData[i], err = encodeStill(alphaCfg, f.frame(tileWidth, tileHeight, alpha, true))
+		}
+		return err
+	})
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	opaque := true
+	for _, data := range alphaData {
+		opaque = opaque && data == nil
+	}
+	if !opaque {
+		// Opaque tiles share the same constant alpha.
+		var opaqueData []byte
+		for i, data := range alphaData {
+			if data != nil {
+				continue
+			}
+			if opaqueData == nil {
+				alpha := e.buffer(&e.alpha[0], ySize, f.depth)
+				alpha.fill(uint16(1)<<f.depth - 1)
+				alphaCfg.threads = C.int(o.Threads)
+				if opaqueData, err = encodeStill(alphaCfg, f.frame(tileWidth, tileHeight, alpha, true)); err != nil {
+					return contextError(ctx, err)
+				}
 			}
+			alphaData[i] = opaqueData
 		}
 	}
 
-	cfg := C.avif_config{
-		threads: C.int(o.Threads),
-		speed:   C.int(o.Speed),
-		quality: C.int(o.Quality),
+	colorImg := f.codedImage(width, height, false)
+	colorImg.clap = clap
+	var alphaImg *av1Image
+	if !opaque {
+		alphaImg = f.codedImage(width, height, true)
 	}
-	frame := C.avif_frame{
-		width:       C.uint16_t(width),
-		height:      C.uint16_t(height),
-		subsampling: C.AVIF_SUBSAMPLING_I420,
-		data:        (*C.uint8_t)(dataPtr),
+	// Single frame is stored as is, otherwise frames are the grid tiles.
+	setTiles := func(img *av1Image, tileData [][]byte) {
+		if len(tileData) == 1 {
+			img.obuData = tileData[0]
+			return
+		}
+		img.columns = columns
+		for _, data := range tileData {
+			img.tiles = append(img.tiles, &av1Image{
+				width:       uint32(tileWidth),
+				height:      uint32(tileHeight),
+				subsampling: img.subsampling,
+				depth:       img.depth,
+				monochrome:  img.monochrome,
+				chromaPos:   img.chromaPos,
+				color:       img.color,
+				obuData:     data,
+			})
+		}
 	}
-	obu := C.avif_buffer{
-		buf: nil,
-		sz:  0,
+	setTiles(colorImg, colorData)
+	if alphaImg != nil {
+		setTiles(alphaImg, alphaData)
 	}
-	defer C.free(obu.buf)
-	// TODO(Kagami): Error description.
-	if eErr := C.avif_encode_frame(&cfg, &frame, &obu); eErr != 0 {
-		return EncoderError(eErr)
+
+	meta := &imageMetadata{exif: o.Exif, xmp: o.XMP}
+	if mErr := muxFrame(w, colorImg, alphaImg, meta); mErr != nil {
+		if _, ok := mErr.(MuxerError); ok {
+			return mErr
+		}
+		return MuxerError(mErr.Error())
+	}
+
+	return nil
+}
+
+// Timescale of image sequences, delays are in 100ths of a second like
+// in GIF.
+const sequenceTimescale = 100
+
+// A FrameSource provides frames of the image sequence on demand, so that
+// they don't need to be kept in memory during encoding.
+type FrameSource interface {
+	// Len returns the number of frames.
+	Len() int
+	// Frame returns the i-th frame along with its delay in 100ths of a
+	// second. Frames are requested in order but the sequence may be
+	// traversed several times, the same frame must be returned each time.
+	// The image is not used after the next call.
+	Frame(i int) (image.Image, int)
+}
+
+// A frameSlice is the FrameSource of frames kept in memory.
+type frameSlice struct {
+	frames []image.Image
+	delays []int
+}
+
+func (s *frameSlice) Len() int {
+	return len(s.frames)
+}
+
+func (s *frameSlice) Frame(i int) (image.Image, int) {
+	return s.frames[i], s.delays[i]
+}
+
+// EncodeAll writes the frames to w as AVIF image sequence with the given
+// options, like image/gif.EncodeAll. Delays are the display times of
+// the frames in 100ths of a second, LoopCount option controls the
+// number of repetitions. The first frame is also stored as the still
+// image for viewers not supporting sequences. Default parameters are
+// used if a nil *Options is passed.
+//
+// Frames must be of the same size which can't exceed MaxGridTileSize,
+// grid options are ignored. Rotation and mirroring are only supported
+// for still images.
+func EncodeAll(w io.Writer, frames []image.Image, delays []int, o *Options) error {
+	e, err := NewEncoder(o)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+	return e.EncodeAll(w, frames, delays)
+}
+
+// EncodeAllContext is like EncodeAll but aborts encoding once the
+// context is done. The context error is returned in that case.
+func EncodeAllContext(ctx context.Context, w io.Writer, frames []image.Image, delays []int, o *Options) error {
+	e, err := NewEncoder(o)
+	if err != nil {
+		return err
 	}
+	defer e.Close()
+	return e.EncodeAllContext(ctx, w, frames, delays)
+}
+
+// EncodeAll writes the frames to w as AVIF image sequence with the
+// encoder options. See package-level EncodeAll for the details.
+func (e *Encoder) EncodeAll(w io.Writer, frames []image.Image, delays []int) error {
+	return e.EncodeAllContext(context.Background(), w, frames, delays)
+}
 
-	obuData := (*[1 << 30]byte)(obu.buf)[:obu.sz:obu.sz]
-	if mErr := muxFrame(w, m, *o.SubsampleRatio, obuData); mErr != nil {
+// EncodeAllContext is like EncodeAll but aborts encoding once the
+// context is done. The context error is returned in that case.
+func (e *Encoder) EncodeAllContext(ctx context.Context, w io.Writer, frames []image.Image, delays []int) error {
+	if len(delays) != len(frames) {
+		return OptionsError("number of delays doesn't match number of frames")
+	}
+	return e.EncodeSequenceContext(ctx, w, &frameSlice{frames, delays})
+}
+
+// EncodeSequence is like EncodeAll but frames are read from the source
+// while encoding, only one of them is converted at a time. Source is
+// traversed once to check the frames and then once per encoding pass.
+func (e *Encoder) EncodeSequence(w io.Writer, src FrameSource) error {
+	return e.EncodeSequenceContext(context.Background(), w, src)
+}
+
+// EncodeSequenceContext is like EncodeSequence but aborts encoding once
+// the context is done. The context error is returned in that case.
+func (e *Encoder) EncodeSequenceContext(ctx context.Context, w io.Writer, src FrameSource) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	count := src.Len()
+	if count == 0 {
+		return OptionsError("no frames")
+	}
+	var rec image.Rectangle
+	delays := make([]int, count)
+	gray, raw := true, true
+	for i := range delays {
+		m, delay := src.Frame(i)
+		if i == 0 {
+			rec = m.Bounds()
+		}
+		if m.Bounds().Size() != rec.Size() {
+			return OptionsError("frames must be of the same size")
+		}
+		if delay <= 0 {
+			return OptionsError("bad delay")
+		}
+		delays[i] = delay
+		g, r := e.sourceKind(m)
+		gray, raw = gray && g, raw && r
+	}
+	if rec.Empty() {
+		return OptionsError("empty image")
+	}
+	width, height := rec.Dx(), rec.Dy()
+	if width > MaxGridTileSize || height > MaxGridTileSize {
+		return OptionsError("frame is too large for sequence")
+	}
+	f := e.frameFormat(gray, raw)
+	o := &f.opts
+	if o.Rotation != 0 || o.Mirror != MirrorNone {
+		return OptionsError("rotation and mirroring of sequences are not supported")
+	}
+	clap, err := f.cleanAperture(rec)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	canceled := (*C.int)(C.calloc(1, C.sizeof_int))
+	defer C.free(unsafe.Pointer(canceled))
+	stop := watchContext(ctx, canceled)
+	defer stop()
+
+	// Frames are converted one by one into the same buffers. Alpha is
+	// only allocated once the first non-opaque frame is found.
+	ySize, uSize := f.planeSizes(width, height)
+	e.buffers(1)
+	color := e.buffer(&e.color[0], ySize+uSize*2, f.depth)
+	var alpha *frameBuffer
+	cfg, alphaCfg := f.configs(canceled)
+	cfg.threads = C.int(o.Threads)
+	alphaCfg.threads = C.int(o.Threads)
+	colorFrame := f.frame(width, height, color, false)
+	colorSession, err := newEncodeSession(cfg, colorFrame, count, sequenceTimescale)
+	if err != nil {
+		return err
+	}
+	defer colorSession.close()
+	var alphaSession *encodeSession
+	var alphaFrame C.avif_frame
+	defer func() {
+		if alphaSession != nil {
+			alphaSession.close()
+		}
+	}()
+	// Preceding frames are opaque so the alpha session starts with
+	// constant planes for them.
+	startAlpha := func(n int) error {
+		alpha = e.buffer(&e.alpha[0], ySize, f.depth)
+		alphaFrame = f.frame(width, height, alpha, true)
+		s, err := newEncodeSession(alphaCfg, alphaFrame, count, sequenceTimescale)
+		if err != nil {
+			return err
+		}
+		alphaSession = s
+		if err := alphaSession.beginPass(); err != nil {
+			return err
+		}
+		alpha.fill(uint16(1)<<f.depth - 1)
+		for i := 0; i < n; i++ {
+			if err := alphaSession.add(alphaFrame, delays[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	encode := func() error {
+		for pass := 0; pass < o.Passes; pass++ {
+			if err := colorSession.beginPass(); err != nil {
+				return err
+			}
+			if alphaSession != nil {
+				if err := alphaSession.beginPass(); err != nil {
+					return err
+				}
+			}
+			for i := 0; i < count; i++ {
+				m, _ := src.Frame(i)
+				if m.Bounds().Size() != rec.Size() {
+					return OptionsError("frames must be of the same size")
+				}
+				if !f.convert(m, m.Bounds(), color, alpha, o.Threads) && alphaSession == nil {
+					if err := startAlpha(i); err != nil {
+						return err
+					}
+					f.convert(m, m.Bounds(), color, alpha, o.Threads)
+				}
+				if err := colorSession.add(colorFrame, delays[i]); err != nil {
+					return err
+				}
+				if alphaSession != nil {
+					if err := alphaSession.add(alphaFrame, delays[i]); err != nil {
+						return err
+					}
+				}
+			}
+			if err := colorSession.endPass(); err != nil {
+				return err
+			}
+			if alphaSession != nil {
+				if err := alphaSession.endPass(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := encode(); err != nil {
+		return contextError(ctx, err)
+	}
+
+	newTrack := func(img *av1Image, s *encodeSession) (*av1Track, error) {
+		samples, keyframes, err := s.result()
+		if err != nil {
+			return nil, err
+		}
+		t := &av1Track{image: img, samples: samples, keyframes: keyframes}
+		for _, d := range delays {
+			t.durations = append(t.durations, uint32(d))
+		}
+		return t, nil
+	}
+	colorImg := f.codedImage(width, height, false)
+	colorImg.clap = clap
+	colorTrack, err := newTrack(colorImg, colorSession)
+	if err != nil {
+		return err
+	}
+	colorTrack.handler = itemTypePICT
+	var alphaTrack *av1Track
+	if alphaSession != nil {
+		if alphaTrack, err = newTrack(f.codedImage(width, height, true), alphaSession); err != nil {
+			return err
+		}
+		alphaTrack.handler = handlerTypeAUXV
+	}
+
+	meta := &imageMetadata{exif: o.Exif, xmp: o.XMP}
+	if mErr := muxSequence(w, colorTrack, alphaTrack, meta, sequenceTimescale, o.LoopCount); mErr != nil {
+		if _, ok := mErr.(MuxerError); ok {
+			return mErr
+		}
 		return MuxerError(mErr.Error())
 	}
 
@@ -0,0 +1,110 @@
+package avif
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math/rand"
+	"testing"
+)
+
+func TestGridTileSize(t *testing.T) {
+	tests := []struct {
+		size, tile int
+		subsampled bool
+		want       int
+	}{
+		{100, 0, false, 100},
+		{100, 64, false, 64},
+		{100, 200, false, 100},
+		{MaxGridTileSize, 0, false, MaxGridTileSize},
+		{MaxGridTileSize, 0, true, MaxGridTileSize},
+		// Split into equal tiles above the limit.
+		{MaxGridTileSize + 1, 0, false, 32768},
+		{200000, 0, false, 50000},
+		// Tiles of subsampled dimension are even.
+		{70001, 0, true, 35002},
+		{131071, 0, true, 43692},
+		{131068, 0, true, 65534},
+		{100000, 1000, true, 1000},
+	}
+	for _, test := range tests {
+		got := gridTileSize(test.size, test.tile, test.subsampled)
+		if got != test.want {
+			t.Errorf("%d, %d, %v: got %d, want %d", test.size, test.tile, test.subsampled, got, test.want)
+		}
+		if got > MaxGridTileSize {
+			t.Errorf("%d, %d, %v: tile %d is too large", test.size, test.tile, test.subsampled, got)
+		}
+	}
+}
+
+func TestFrameBufferSize(t *testing.T) {
+	// Larger than a grid tile, views must not be limited by array types.
+	const size = 1<<29 + 1
+	for _, depth := range []uint{8, 10} {
+		b := newFrameBuffer(size, depth)
+		if b.capacity != size*bytesPerSample(depth) {
+			t.Errorf("%d-bit: got capacity %d, want %d", depth, b.capacity, size*bytesPerSample(depth))
+		}
+		// Only the view of the bit depth is set.
+		n, other := len(b.data), len(b.data16)
+		if depth > 8 {
+			n, other = other, n
+		}
+		if n != size || other != 0 {
+			t.Errorf("%d-bit: got views of %d and %d samples, want %d", depth, n, other, size)
+		}
+		b.put(size-1, 1)
+		if !b.reuse(size/2, depth) || b.reuse(size+1, depth) {
+			t.Errorf("%d-bit: bad reuse of capacity %d", depth, b.capacity)
+		}
+		b.free()
+	}
+}
+
+func newEncodeBenchImage() *image.NRGBA {
+	// Smooth gradients with some noise, closer to photos than random
+	// pixels.
+	m := image.NewNRGBA(image.Rect(0, 0, 640, 480))
+	rnd := rand.New(rand.NewSource(1))
+	for j := 0; j < 480; j++ {
+		for i := 0; i < 640; i++ {
+			p := m.Pix[j*m.Stride+i*4:]
+			p[0] = uint8(i*255/639) ^ uint8(rnd.Intn(8))
+			p[1] = uint8(j*255/479) ^ uint8(rnd.Intn(8))
+			p[2] = uint8((i + j) / 5)
+			p[3] = 0xff
+		}
+	}
+	return m
+}
+
+// Report size of the encoded image along with time, single pass trades
+// the former for the latter.
+func BenchmarkEncode(b *testing.B) {
+	m := newEncodeBenchImage()
+	for _, passes := range []int{1, 2} {
+		for speed := MinSpeed; speed <= MaxSpeed; speed++ {
+			b.Run(fmt.Sprintf("passes=%d/speed=%d", passes, speed), func(b *testing.B) {
+				o := DefaultOptions
+				o.Speed = speed
+				o.Passes = passes
+				e, err := NewEncoder(&o)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer e.Close()
+				var buf bytes.Buffer
+				b.ResetTimer()
+				for n := 0; n < b.N; n++ {
+					buf.Reset()
+					if err := e.Encode(&buf, m); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(buf.Len()), "bytes")
+			})
+		}
+	}
+}
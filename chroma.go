@@ -0,0 +1,227 @@
+package avif
+
+import (
+	"math"
+	"sync"
+)
+
+// Chroma sample positions as defined in AV1 specification.
+const (
+	cspUnknown   = 0
+	cspVertical  = 1
+	cspColocated = 2
+)
+
+// A chromaKernel is the filter kernel along with the position of the
+// chroma sample relative to the top-left luma sample of the block, in
+// luma samples.
+type chromaKernel struct {
+	support float64
+	fn      func(t float64) float64
+	xOffset float64
+	yOffset float64
+}
+
+var chromaKernels = map[ChromaFilter]chromaKernel{
+	ChromaFilterBox: {0.5, func(t float64) float64 {
+		return 1
+	}, 0.5, 0.5},
+	ChromaFilterBilinear: {1, func(t float64) float64 {
+		return 1 - math.Abs(t)
+	}, 0, 0.5},
+	ChromaFilterCatmullRom: {2, func(t float64) float64 {
+		t = math.Abs(t)
+		if t < 1 {
+			return 1.5*t*t*t - 2.5*t*t + 1
+		}
+		return -0.5*t*t*t + 2.5*t*t - 4*t + 2
+	}, 0, 0.5},
+}
+
+// Return chroma sample position of the filter in 4:2:0 image.
+func chromaSamplePosition(filter ChromaFilter) uint8 {
+	if filter == ChromaFilterPoint {
+		return cspColocated
+	}
+	k := chromaKernels[filter]
+	if k.xOffset == 0 && k.yOffset == 0.5 {
+		return cspVertical
+	}
+	return cspUnknown
+}
+
+// A chromaTap is the weight of luma position neighbour.
+type chromaTap struct {
+	d int
+	w float32
+}
+
+// Return filter taps for the given dimension, either subsampled by 2 or
+// not subsampled.
+func chromaTaps(k chromaKernel, offset float64, subsampled bool) []chromaTap {
+	if !subsampled {
+		return []chromaTap{{0, 1}}
+	}
+	// Kernel is stretched twice to cover the block.
+	var taps []chromaTap
+	sum := 0.0
+	for d := int(math.Floor(offset - 2*k.support)); float64(d) <= offset+2*k.support; d++ {
+		t := (float64(d) - offset) / 2
+		if math.Abs(t) >= k.support {
+			continue
+		}
+		if w := k.fn(t); w != 0 {
+			taps = append(taps, chromaTap{d, float32(w)})
+			sum += w
+		}
+	}
+	for i := range taps {
+		taps[i].w /= float32(sum)
+	}
+	return taps
+}
+
+// A chromaSampler computes chroma samples of the frame from the
+// filtered RGB values.
+type chromaSampler struct {
+	hTaps  []chromaTap
+	vTaps  []chromaTap
+	linear bool
+}
+
+func newChromaSampler(filter ChromaFilter, linear bool, sx, sy bool) *chromaSampler {
+	k := chromaKernels[filter]
+	s := &chromaSampler{
+		hTaps:  chromaTaps(k, k.xOffset, sx),
+		vTaps:  chromaTaps(k, k.yOffset, sy),
+		linear: linear,
+	}
+	if linear {
+		initLinearTables()
+	}
+	return s
+}
+
+// Lookup tables for sRGB transfer function, 16-bit gamma-encoded values
+// to linear light in [0, 1] range and back from linear light quantized
+// to 16 bits.
+var (
+	linearOnce sync.Once
+	toLinear   []float32
+	fromLinear []uint16
+)
+
+func initLinearTables() {
+	linearOnce.Do(func() {
+		toLinear = make([]float32, 0x10000)
+		fromLinear = make([]uint16, 0x10000)
+		for i := range toLinear {
+			v := float64(i) / 0xffff
+			if v <= 0.04045 {
+				v /= 12.92
+			} else {
+				v = math.Pow((v+0.055)/1.055, 2.4)
+			}
+			toLinear[i] = float32(v)
+		}
+		for i := range fromLinear {
+			v := float64(i) / 0xffff
+			if v <= 0.0031308 {
+				v *= 12.92
+			} else {
+				v = 1.055*math.Pow(v, 1/2.4) - 0.055
+			}
+			fromLinear[i] = uint16(v*0xffff + 0.5)
+		}
+	})
+}
+
+// Convert filtered value back to 16-bit sample.
+func (s *chromaSampler) sample(v float32) uint32 {
+	if s.linear {
+		v *= 0xffff
+	}
+	if v <= 0 {
+		return 0
+	}
+	if v >= 0xffff {
+		v = 0xffff
+	}
+	if s.linear {
+		return uint32(fromLinear[uint32(v+0.5)])
+	}
+	return uint32(v + 0.5)
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// Compute chroma rows in [cj0, cj1) range.
+func (c *converter) convertChromaRows(cj0, cj1 int) {
+	s := c.chroma
+	width, height := c.rec.Dx(), c.rec.Dy()
+	cw := (width + c.xMask) >> uint(c.xMask)
+	row := make([]uint32, width*4)
+	// Horizontally filtered rows are cached since they're shared by
+	// vertical taps of neighbouring chroma rows. Rows needed by single
+	// chroma row are consecutive so they never collide in the ring.
+	span := s.vTaps[len(s.vTaps)-1].d - s.vTaps[0].d + 1
+	ring := make([][]float32, span)
+	ringY := make([]int, span)
+	for i := range ring {
+		ring[i] = make([]float32, cw*3)
+		ringY[i] = -1
+	}
+	filterRow := func(y int) []float32 {
+		h := ring[y%span]
+		if ringY[y%span] == y {
+			return h
+		}
+		ringY[y%span] = y
+		c.read(c.rec.Min.X, c.rec.Min.Y+y, row)
+		for cx := 0; cx < cw; cx++ {
+			var r, g, b float32
+			for _, t := range s.hTaps {
+				x := clampInt(cx<<uint(c.xMask)+t.d, 0, width-1)
+				p := row[x*4 : x*4+3 : x*4+3]
+				if s.linear {
+					r += t.w * toLinear[p[0]]
+					g += t.w * toLinear[p[1]]
+					b += t.w * toLinear[p[2]]
+				} else {
+					r += t.w * float32(p[0])
+					g += t.w * float32(p[1])
+					b += t.w * float32(p[2])
+				}
+			}
+			h[cx*3], h[cx*3+1], h[cx*3+2] = r, g, b
+		}
+		return h
+	}
+	acc := make([]float32, cw*3)
+	for cj := cj0; cj < cj1; cj++ {
+		for i := range acc {
+			acc[i] = 0
+		}
+		for _, t := range s.vTaps {
+			y := clampInt(cj<<uint(c.yMask)+t.d, 0, height-1)
+			for i, v := range filterRow(y) {
+				acc[i] += t.w * v
+			}
+		}
+		uPos := c.ySize + cj*cw
+		for cx := 0; cx < cw; cx++ {
+			r, g, b := s.sample(acc[cx*3]), s.sample(acc[cx*3+1]), s.sample(acc[cx*3+2])
+			u, v := c.matrix.uv(r, g, b)
+			c.color.put(uPos+cx, u)
+			c.color.put(uPos+c.uSize+cx, v)
+		}
+	}
+}
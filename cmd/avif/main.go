@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"image"
+	"image/draw"
+	"image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
+	"io/ioutil"
 	"os"
 
 	"github.com/Kagami/go-avif"
@@ -26,20 +30,192 @@ Options:
   -q <qp>, --quality=<qp>   Compression level (0..63), [default: 25]
   -s <spd>, --speed=<spd>   Compression speed (0..8), [default: 4]
   -t <td>, --threads=<td>   Number of threads (0..64, 0 for all available cores), [default: 0]
+  -d <bd>, --depth=<bd>     Bit depth (8, 10 or 12), [default: 8]
+  --alpha-quality=<qp>      Alpha channel compression level (0..63), [default: 0]
+  --subsampling=<ss>        Chroma subsampling (420, 422 or 444), [default: 420]
+  --monochrome              Encode luma plane only (grayscale)
+  --chroma-filter=<f>       Chroma downsampling filter (point, box, bilinear or catmull-rom), [default: bilinear]
+  --linear-light            Downsample chroma in linear light
+  --matrix=<mc>             YCbCr matrix (bt709, bt601, bt2020 or identity), [default: bt709]
+  --full-range              Use full range of sample values
+  --grid-tile-width=<w>     Width of grid tiles (64..65535, 0 for automatic), [default: 0]
+  --grid-tile-height=<h>    Height of grid tiles (64..65535, 0 for automatic), [default: 0]
+  --tune=<t>                Metric to optimize for (psnr or ssim), [default: psnr]
+  --sharpness=<n>           Preserve edges and texture (0..7), [default: 0]
+  --aq-mode=<m>             Adaptive quantization (default, none, variance, complexity or cyclic), [default: default]
+  --deltaq-mode=<m>         Quantizer adjustment per superblock (default, none, objective or perceptual), [default: default]
+  --chroma-deltaq           Adjust chroma quantizers too
+  --min-quantizer=<qp>      Lower bound of quantizer (0..63), [default: 0]
+  --max-quantizer=<qp>      Upper bound of quantizer (1..63), [default: 63]
+  --qm                      Use quantization matrices
+  --denoise=<l>             Denoise and synthesize film grain (0..50, 0 to disable), [default: 0]
+  --tile-rows-log2=<n>      Log2 of number of AV1 tile rows (0..6, -1 for automatic), [default: -1]
+  --tile-cols-log2=<n>      Log2 of number of AV1 tile columns (0..6, -1 for automatic), [default: -1]
+  --passes=<n>              Number of encoding passes (1 or 2), [default: 2]
   --lossless                Lossless compression (alias for -q 0)
   --best                    Slowest compression method (alias for -s 0)
   --fast                    Fastest compression method (alias for -s 8)
 `
 
 type config struct {
-	Encode   string
-	Output   string
-	Quality  int
-	Speed    int
-	Threads  int
-	Lossless bool
-	Best     bool
-	Fast     bool
+	Encode         string
+	Output         string
+	Quality        int
+	Speed          int
+	Threads        int
+	Depth          int
+	AlphaQuality   int
+	Subsampling    string
+	Monochrome     bool
+	ChromaFilter   string
+	LinearLight    bool
+	Matrix         string
+	FullRange      bool
+	GridTileWidth  int
+	GridTileHeight int
+	Tune           string
+	Sharpness      int
+	AQMode         string `docopt:"--aq-mode"`
+	DeltaQMode     string `docopt:"--deltaq-mode"`
+	ChromaDeltaQ   bool   `docopt:"--chroma-deltaq"`
+	MinQuantizer   int
+	MaxQuantizer   int
+	QM             bool `docopt:"--qm"`
+	Denoise        int
+	TileRowsLog2   int `docopt:"--tile-rows-log2"`
+	TileColsLog2   int `docopt:"--tile-cols-log2"`
+	Passes         int
+	Lossless       bool
+	Best           bool
+	Fast           bool
+}
+
+var subsamplings = map[string]image.YCbCrSubsampleRatio{
+	"420": image.YCbCrSubsampleRatio420,
+	"422": image.YCbCrSubsampleRatio422,
+	"444": image.YCbCrSubsampleRatio444,
+}
+
+var matrices = map[string]avif.MatrixCoefficients{
+	"bt709":    avif.MatrixBT709,
+	"bt601":    avif.MatrixBT601,
+	"bt2020":   avif.MatrixBT2020NCL,
+	"identity": avif.MatrixIdentity,
+}
+
+var chromaFilters = map[string]avif.ChromaFilter{
+	"point":       avif.ChromaFilterPoint,
+	"box":         avif.ChromaFilterBox,
+	"bilinear":    avif.ChromaFilterBilinear,
+	"catmull-rom": avif.ChromaFilterCatmullRom,
+}
+
+var tunes = map[string]avif.Tune{
+	"psnr": avif.TunePSNR,
+	"ssim": avif.TuneSSIM,
+}
+
+var aqModes = map[string]avif.AQMode{
+	"default":    avif.AQModeDefault,
+	"none":       avif.AQModeNone,
+	"variance":   avif.AQModeVariance,
+	"complexity": avif.AQModeComplexity,
+	"cyclic":     avif.AQModeCyclic,
+}
+
+var deltaQModes = map[string]avif.DeltaQMode{
+	"default":    avif.DeltaQDefault,
+	"none":       avif.DeltaQNone,
+	"objective":  avif.DeltaQObjective,
+	"perceptual": avif.DeltaQPerceptual,
+}
+
+// Transformations corresponding to EXIF orientations.
+var orientations = map[int]struct {
+	rotation int
+	mirror   avif.Mirror
+}{
+	2: {0, avif.MirrorVertical},
+	3: {180, avif.MirrorNone},
+	4: {0, avif.MirrorHorizontal},
+	5: {90, avif.MirrorHorizontal},
+	6: {270, avif.MirrorNone},
+	7: {90, avif.MirrorVertical},
+	8: {90, avif.MirrorNone},
+}
+
+var gifSignature = []byte("GIF8")
+
+// Browsers show GIF frames with smaller delays (in 100ths of a second)
+// for the default time.
+const (
+	minGIFDelay     = 2
+	defaultGIFDelay = 10
+)
+
+// A gifFrames renders frames of the GIF animation on the whole canvas
+// the way browsers do: according to disposal methods, with transparent
+// background. Frames are rendered on demand into the same canvas so
+// only the current one is kept in memory.
+type gifFrames struct {
+	g        *gif.GIF
+	canvas   *image.RGBA
+	previous *image.RGBA
+	next     int // index of the frame to be rendered next
+}
+
+func newGIFFrames(g *gif.GIF) *gifFrames {
+	rec := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	return &gifFrames{
+		g:        g,
+		canvas:   image.NewRGBA(rec),
+		previous: image.NewRGBA(rec),
+	}
+}
+
+func (s *gifFrames) disposal(i int) byte {
+	if i < len(s.g.Disposal) {
+		return s.g.Disposal[i]
+	}
+	return 0
+}
+
+func (s *gifFrames) render(i int) {
+	if i == 0 {
+		draw.Draw(s.canvas, s.canvas.Rect, image.Transparent, image.Point{}, draw.Src)
+	} else {
+		// Dispose of the previous frame.
+		prev := s.g.Image[i-1]
+		switch s.disposal(i - 1) {
+		case gif.DisposalBackground:
+			draw.Draw(s.canvas, prev.Rect, image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(s.canvas.Pix, s.previous.Pix)
+		}
+	}
+	if s.disposal(i) == gif.DisposalPrevious {
+		copy(s.previous.Pix, s.canvas.Pix)
+	}
+	frame := s.g.Image[i]
+	draw.Draw(s.canvas, frame.Rect, frame, frame.Rect.Min, draw.Over)
+}
+
+func (s *gifFrames) Len() int {
+	return len(s.g.Image)
+}
+
+func (s *gifFrames) Frame(i int) (image.Image, int) {
+	if i < s.next-1 {
+		s.next = 0
+	}
+	for ; s.next <= i; s.next++ {
+		s.render(s.next)
+	}
+	delay := s.g.Delay[i]
+	if delay < minGIFDelay {
+		delay = defaultGIFDelay
+	}
+	return s.canvas, delay
 }
 
 func checkErr(err error) {
@@ -49,6 +225,16 @@ func checkErr(err error) {
 	}
 }
 
+// Report error of optional step, the conversion continues without its
+// result. Returns whether there was an error.
+func warnErr(err error, fallback string) bool {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v, %s\n", err, fallback)
+		return true
+	}
+	return false
+}
+
 func check(cond bool, errStr string) {
 	if !cond {
 		fmt.Println(errStr)
@@ -65,6 +251,44 @@ func main() {
 	check(conf.Quality >= avif.MinQuality && conf.Quality <= avif.MaxQuality, "bad quality (0..63)")
 	check(conf.Speed >= avif.MinSpeed && conf.Speed <= avif.MaxSpeed, "bad speed (0..8)")
 	check(conf.Threads == 0 || (conf.Threads >= avif.MinThreads && conf.Threads <= avif.MaxThreads), "bad threads (0..64)")
+	check(conf.AlphaQuality >= avif.MinQuality && conf.AlphaQuality <= avif.MaxQuality, "bad alpha quality (0..63)")
+	check(conf.Depth == 8 || conf.Depth == 10 || conf.Depth == 12, "bad depth (8, 10 or 12)")
+	subsampling, ok := subsamplings[conf.Subsampling]
+	check(ok, "bad subsampling (420, 422 or 444)")
+	chromaFilter, ok := chromaFilters[conf.ChromaFilter]
+	check(ok, "bad chroma filter (point, box, bilinear or catmull-rom)")
+	matrix, ok := matrices[conf.Matrix]
+	check(ok, "bad matrix (bt709, bt601, bt2020 or identity)")
+	check(matrix != avif.MatrixIdentity || subsampling == image.YCbCrSubsampleRatio444 || conf.Monochrome,
+		"identity matrix requires 444 subsampling")
+	for _, size := range []int{conf.GridTileWidth, conf.GridTileHeight} {
+		check(size == 0 || (size >= avif.MinGridTileSize && size <= avif.MaxGridTileSize), "bad grid tile size (64..65535)")
+	}
+	tune, ok := tunes[conf.Tune]
+	check(ok, "bad tune (psnr or ssim)")
+	check(conf.Sharpness >= avif.MinSharpness && conf.Sharpness <= avif.MaxSharpness, "bad sharpness (0..7)")
+	aqMode, ok := aqModes[conf.AQMode]
+	check(ok, "bad AQ mode (default, none, variance, complexity or cyclic)")
+	deltaQMode, ok := deltaQModes[conf.DeltaQMode]
+	check(ok, "bad delta q mode (default, none, objective or perceptual)")
+	check(conf.MinQuantizer >= avif.MinQuality && conf.MinQuantizer <= avif.MaxQuality, "bad min quantizer (0..63)")
+	// Zero is the unset value of the library.
+	check(conf.MaxQuantizer >= 1 && conf.MaxQuantizer <= avif.MaxQuality, "bad max quantizer (1..63)")
+	check(conf.MinQuantizer <= conf.MaxQuantizer, "min quantizer exceeds max quantizer")
+	check(conf.Denoise >= avif.MinDenoiseLevel && conf.Denoise <= avif.MaxDenoiseLevel, "bad denoise level (0..50)")
+	// Library uses 0 for automatic tiling.
+	tilesLog2 := func(n int) int {
+		check(n >= -1 && n <= avif.MaxTilesLog2, "bad number of tiles (0..6 or -1)")
+		switch n {
+		case -1:
+			return avif.TilesAuto
+		case 0:
+			return avif.TilesSingle
+		}
+		return n
+	}
+	tileRowsLog2, tileColsLog2 := tilesLog2(conf.TileRowsLog2), tilesLog2(conf.TileColsLog2)
+	check(conf.Passes == 1 || conf.Passes == 2, "bad number of passes (1 or 2)")
 	check(!conf.Best || !conf.Fast, "can't use both --best and --fast")
 	if conf.Lossless {
 		conf.Quality = 0
@@ -75,9 +299,31 @@ func main() {
 		conf.Speed = 8
 	}
 	avifOpts := avif.Options{
-		Speed:   conf.Speed,
-		Quality: conf.Quality,
-		Threads: conf.Threads,
+		Speed:                conf.Speed,
+		Quality:              conf.Quality,
+		Threads:              conf.Threads,
+		SubsampleRatio:       &subsampling,
+		BitDepth:             conf.Depth,
+		AlphaQuality:         conf.AlphaQuality,
+		Monochrome:           conf.Monochrome,
+		ChromaFilter:         chromaFilter,
+		LinearLight:          conf.LinearLight,
+		MatrixCoefficients:   matrix,
+		FullRange:            conf.FullRange,
+		GridTileWidth:        conf.GridTileWidth,
+		GridTileHeight:       conf.GridTileHeight,
+		Tune:                 tune,
+		Sharpness:            conf.Sharpness,
+		AQMode:               aqMode,
+		DeltaQMode:           deltaQMode,
+		ChromaDeltaQ:         conf.ChromaDeltaQ,
+		MinQuantizer:         conf.MinQuantizer,
+		MaxQuantizer:         conf.MaxQuantizer,
+		QuantizationMatrices: conf.QM,
+		DenoiseLevel:         conf.Denoise,
+		TileRowsLog2:         tileRowsLog2,
+		TileColsLog2:         tileColsLog2,
+		Passes:               conf.Passes,
 	}
 
 	var src io.Reader
@@ -99,9 +345,66 @@ func main() {
 		dst = file
 	}
 
+	// Source is read in memory to extract metadata along with decoding.
+	data, err := ioutil.ReadAll(src)
+	checkErr(err)
 	// TODO(Kagami): Accept y4m.
-	img, _, err := image.Decode(src)
+	if bytes.HasPrefix(data, gifSignature) {
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		checkErr(err)
+		frames := newGIFFrames(g)
+		if frames.Len() > 1 {
+			avifOpts.LoopCount = g.LoopCount
+			e, err := avif.NewEncoder(&avifOpts)
+			checkErr(err)
+			defer e.Close()
+			err = e.EncodeSequence(dst, frames)
+			checkErr(err)
+		} else {
+			frame, _ := frames.Frame(0)
+			err = avif.Encode(dst, frame, &avifOpts)
+			checkErr(err)
+		}
+		return
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
 	checkErr(err)
+	switch format {
+	case "jpeg":
+		avifOpts.ICCProfile, err = avif.ICCFromJPEG(data)
+		if warnErr(err, "assuming sRGB") {
+			avifOpts.ICCProfile = nil
+		}
+		avifOpts.Exif, err = avif.ExifFromJPEG(data)
+		if warnErr(err, "skipping EXIF") {
+			avifOpts.Exif = nil
+		}
+		avifOpts.XMP, err = avif.XMPFromJPEG(data)
+		if warnErr(err, "skipping XMP") {
+			avifOpts.XMP = nil
+		}
+		if avifOpts.Exif != nil {
+			// Pixels are stored as is and viewers apply transformations
+			// signaled in the container.
+			var orientation int
+			orientation, err = avif.ExifOrientation(avifOpts.Exif)
+			if warnErr(err, "ignoring orientation") {
+				orientation = 1
+			}
+			if t, ok := orientations[orientation]; ok {
+				avifOpts.Rotation, avifOpts.Mirror = t.rotation, t.mirror
+				// Otherwise the image is transformed twice by viewers
+				// reading both.
+				avifOpts.Exif, err = avif.ResetExifOrientation(avifOpts.Exif)
+				checkErr(err)
+			}
+		}
+	case "png":
+		avifOpts.ICCProfile, err = avif.ICCFromPNG(data)
+		if warnErr(err, "assuming sRGB") {
+			avifOpts.ICCProfile = nil
+		}
+	}
 
 	err = avif.Encode(dst, img, &avifOpts)
 	checkErr(err)
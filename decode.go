@@ -0,0 +1,745 @@
+package avif
+
+// #include <stdlib.h>
+// #include "av1.h"
+import "C"
+import (
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"unsafe"
+)
+
+func init() {
+	image.RegisterFormat("avif", "????ftypavif", Decode, DecodeConfig)
+	// Image sequences are decoded as their still image.
+	image.RegisterFormat("avif", "????ftypavis", Decode, DecodeConfig)
+	// Other encoders may use generic HEIF brands and list avif among
+	// compatible brands only, which is checked on demuxing.
+	image.RegisterFormat("avif", "????ftypmif1", Decode, DecodeConfig)
+	image.RegisterFormat("avif", "????ftypmiaf", Decode, DecodeConfig)
+}
+
+var (
+	boxTypeIDAT = fourCC{'i', 'd', 'a', 't'}
+
+	auxTypeAlphaHEVC = "urn:mpeg:hevc:2015:auxid:1"
+)
+
+// A demuxedFile is the parsed HEIF structure along with the file data
+// item locations refer to.
+type demuxedFile struct {
+	data     []byte
+	fileType *boxFTYP
+	metadata *boxMETA
+	idat     []byte
+}
+
+func demux(data []byte) (*demuxedFile, error) {
+	boxes, err := parseBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+	f := &demuxedFile{data: data}
+	for _, b := range boxes {
+		switch b := b.(type) {
+		case *boxFTYP:
+			if f.fileType == nil {
+				f.fileType = b
+			}
+		case *boxMETA:
+			if f.metadata == nil {
+				f.metadata = b
+			}
+		}
+	}
+	if f.fileType == nil || f.metadata == nil {
+		return nil, DemuxerError("missing ftyp or meta box")
+	}
+	if err := checkFTYP(f.fileType); err != nil {
+		return nil, err
+	}
+	for _, b := range f.metadata.other {
+		if u, ok := b.(*boxUnknown); ok && u.typ == boxTypeIDAT {
+			f.idat = u.data
+		}
+	}
+	if f.item(f.primaryID()) == nil || f.location(f.primaryID()) == nil {
+		return nil, DemuxerError("missing primary item")
+	}
+	return f, nil
+}
+
+func checkFTYP(b *boxFTYP) error {
+	if b.majorBrand == itemTypeAVIF {
+		return nil
+	}
+	for _, brand := range b.compatibleBrands {
+		if brand == itemTypeAVIF {
+			return nil
+		}
+	}
+	return DemuxerError("not an AVIF file")
+}
+
+func (f *demuxedFile) primaryID() uint16 {
+	return f.metadata.primaryResource.itemID
+}
+
+// Return info entry of the item or nil.
+func (f *demuxedFile) item(id uint16) *boxINFEv2 {
+	infos := f.metadata.itemInfos.itemInfos
+	for i := range infos {
+		if infos[i].itemID == id {
+			return &infos[i]
+		}
+	}
+	return nil
+}
+
+// Return location of the item or nil.
+func (f *demuxedFile) location(id uint16) *boxILOCItem {
+	items := f.metadata.itemLocations.items
+	for i := range items {
+		if items[i].itemID == id {
+			return &items[i]
+		}
+	}
+	return nil
+}
+
+func (f *demuxedFile) itemProps(id uint16) []boxIPMAAssociationProperty {
+	for _, a := range f.metadata.itemProps.association.entries {
+		if a.itemID == id {
+			return a.props
+		}
+	}
+	return nil
+}
+
+// Return property by its 1-based index or nil.
+func (f *demuxedFile) property(index uint16) boxIPCOProperty {
+	props := f.metadata.itemProps.propertyContainer.properties
+	if index == 0 || int(index) > len(props) {
+		return nil
+	}
+	return props[index-1]
+}
+
+// Return the first property of the given type associated with the item
+// or nil.
+func (f *demuxedFile) itemProperty(id uint16, typ fourCC) boxIPCOProperty {
+	for _, p := range f.itemProps(id) {
+		if prop := f.property(p.propertyIndex); prop != nil && prop.Type() == typ {
+			return prop
+		}
+	}
+	return nil
+}
+
+// Return nclx colour information of the item or nil.
+func (f *demuxedFile) nclx(id uint16) *boxCOLR {
+	for _, p := range f.itemProps(id) {
+		colr, _ := f.property(p.propertyIndex).(*boxCOLR)
+		if colr != nil && colr.colourType == colourTypeNCLX {
+			return colr
+		}
+	}
+	return nil
+}
+
+// A transform maps coordinates of the decoded frame to the displayed
+// image.
+type transform struct {
+	xx, xy, x0    int             // x' = xx*x + xy*y + x0
+	yx, yy, y0    int             // y' = yx*x + yy*y + y0
+	width, height int             // of the displayed image
+	rec           image.Rectangle // displayed region of the frame
+}
+
+func newTransform(width, height int) *transform {
+	return &transform{
+		xx: 1, yy: 1,
+		width: width, height: height,
+		rec: image.Rect(0, 0, width, height),
+	}
+}
+
+// Crop to the rectangle of the displayed image.
+func (t *transform) crop(r image.Rectangle) {
+	// Matrix is orthogonal so it's inverted by transposition.
+	inverse := func(x, y int) image.Point {
+		x, y = x-t.x0, y-t.y0
+		return image.Pt(t.xx*x+t.yx*y, t.xy*x+t.yy*y)
+	}
+	p0 := inverse(r.Min.X, r.Min.Y)
+	p1 := inverse(r.Max.X-1, r.Max.Y-1)
+	t.rec = image.Rect(p0.X, p0.Y, p1.X, p1.Y)
+	t.rec.Max = t.rec.Max.Add(image.Pt(1, 1))
+	t.x0 -= r.Min.X
+	t.y0 -= r.Min.Y
+	t.width, t.height = r.Dx(), r.Dy()
+}
+
+// Rotate by 90 degrees anti-clockwise.
+func (t *transform) rotate() {
+	*t = transform{
+		xx: t.yx, xy: t.yy, x0: t.y0,
+		yx: -t.xx, yy: -t.xy, y0: t.width - 1 - t.x0,
+		width: t.height, height: t.width,
+		rec: t.rec,
+	}
+}
+
+// Mirror about vertical (0) or horizontal (1) axis.
+func (t *transform) mirror(axis uint8) {
+	if axis == 0 {
+		t.xx, t.xy, t.x0 = -t.xx, -t.xy, t.width-1-t.x0
+	} else {
+		t.yx, t.yy, t.y0 = -t.yx, -t.yy, t.height-1-t.y0
+	}
+}
+
+func (t *transform) apply(x, y int) (int, int) {
+	return t.xx*x + t.xy*y + t.x0, t.yx*x + t.yy*y + t.y0
+}
+
+// Return transform defined by transformative properties of the item of
+// the given size.
+func (f *demuxedFile) transform(id uint16, width, height int) (*transform, error) {
+	t := newTransform(width, height)
+	// Properties are applied in order of association.
+	for _, p := range f.itemProps(id) {
+		switch prop := f.property(p.propertyIndex).(type) {
+		case *boxCLAP:
+			r, ok := prop.rect(t.width, t.height)
+			if !ok {
+				return nil, DemuxerError("unsupported clean aperture")
+			}
+			t.crop(r)
+		case *boxIROT:
+			for i := uint8(0); i < prop.angle; i++ {
+				t.rotate()
+			}
+		case *boxIMIR:
+			t.mirror(prop.axis)
+		}
+	}
+	return t, nil
+}
+
+// Make sure we understand all essential properties of the item.
+func (f *demuxedFile) checkEssential(id uint16) error {
+	for _, p := range f.itemProps(id) {
+		if !p.essential || p.propertyIndex == 0 {
+			continue
+		}
+		prop := f.property(p.propertyIndex)
+		if prop == nil {
+			return DemuxerError("bad property index")
+		}
+		switch prop.(type) {
+		case *boxAV1C, *boxPIXI, *boxAUXC, *boxISPE, *boxPASP, *boxCLAP, *boxIROT, *boxIMIR:
+		default:
+			return DemuxerError("unsupported essential property")
+		}
+	}
+	return nil
+}
+
+func (f *demuxedFile) itemData(id uint16) ([]byte, error) {
+	loc := f.location(id)
+	if loc == nil {
+		return nil, DemuxerError("missing item location")
+	}
+	if loc.dataReferenceIndex != 0 {
+		return nil, DemuxerError("external data references are not supported")
+	}
+	var src []byte
+	switch loc.constructionMethod {
+	case 0:
+		src = f.data
+	case 1:
+		src = f.idat
+	default:
+		return nil, DemuxerError("unsupported construction method")
+	}
+	var data []byte
+	for _, e := range loc.extents {
+		start := loc.baseOffset + e.extentOffset
+		end := start + e.extentLength
+		if e.extentLength == 0 {
+			// Zero length means extent spans to the end of the source.
+			end = uint64(len(src))
+		}
+		if start < loc.baseOffset || start > end || end > uint64(len(src)) {
+			return nil, DemuxerError("item data out of bounds")
+		}
+		data = append(data, src[start:end]...)
+	}
+	if len(data) == 0 {
+		return nil, DemuxerError("empty item data")
+	}
+	return data, nil
+}
+
+// Return IDs of the items the given one refers to with the reference of
+// the given type.
+func (f *demuxedFile) references(typ fourCC, id uint16) []uint16 {
+	if f.metadata.itemRefs == nil {
+		return nil
+	}
+	for _, ref := range f.metadata.itemRefs.references {
+		if ref.typ == typ && ref.fromItemID == id {
+			return ref.toItemIDs
+		}
+	}
+	return nil
+}
+
+// Return AV1 configuration of the image item, the one of the first tile
+// for the grid, or nil.
+func (f *demuxedFile) av1Config(id uint16) *boxAV1C {
+	if info := f.item(id); info != nil && info.itemType == itemTypeGRID {
+		tiles := f.references(refTypeDIMG, id)
+		if len(tiles) == 0 {
+			return nil
+		}
+		id = tiles[0]
+	}
+	av1C, _ := f.itemProperty(id, boxTypeAV1C).(*boxAV1C)
+	return av1C
+}
+
+// Find alpha auxiliary item of the given image, 0 if there is none.
+func (f *demuxedFile) alphaID(id uint16) uint16 {
+	if f.metadata.itemRefs == nil {
+		return 0
+	}
+	for _, ref := range f.metadata.itemRefs.references {
+		if ref.typ != refTypeAUXL || len(ref.toItemIDs) != 1 || ref.toItemIDs[0] != id {
+			continue
+		}
+		info := f.item(ref.fromItemID)
+		if info == nil || info.itemType != itemTypeAV01 && info.itemType != itemTypeGRID {
+			continue
+		}
+		auxC, _ := f.itemProperty(ref.fromItemID, boxTypeAUXC).(*boxAUXC)
+		if auxC != nil && (auxC.auxType == auxTypeAlpha || auxC.auxType == auxTypeAlphaHEVC) {
+			return ref.fromItemID
+		}
+	}
+	return 0
+}
+
+//----------------------------------------------------------------------
+
+// A plane holds decoded samples of the single plane.
+type plane struct {
+	width  int
+	height int
+	pix    []uint16
+}
+
+func (p *plane) at(x, y int) uint16 {
+	return p.pix[y*p.width+x]
+}
+
+// Copy samples of the other plane to the given position.
+func (p *plane) paste(src plane, x, y int) {
+	for j := 0; j < src.height; j++ {
+		copy(p.pix[(y+j)*p.width+x:], src.pix[j*src.width:(j+1)*src.width])
+	}
+}
+
+// A decodedFrame is the decoded AV1 frame converted to Go memory.
+type decodedFrame struct {
+	width      int
+	height     int
+	depth      uint
+	monochrome bool
+	color      C.avif_color_config
+	// Chroma planes are subsampled by 1<<sx and 1<<sy.
+	sx, sy  uint
+	y, u, v plane
+}
+
+func decodeFrame(obuData []byte) (*decodedFrame, error) {
+	obuPtr := C.CBytes(obuData)
+	defer C.free(obuPtr)
+	obu := C.avif_buffer{
+		buf: obuPtr,
+		sz:  C.size_t(len(obuData)),
+	}
+	var frame C.avif_frame
+	var color C.avif_color_config
+	threads := runtime.NumCPU()
+	if threads > MaxThreads {
+		threads = MaxThreads
+	}
+	dErr := C.avif_decode_frame(C.int(threads), &obu, &frame, &color)
+	defer C.free(unsafe.Pointer(frame.data))
+	if dErr != 0 {
+		return nil, DecoderError(dErr)
+	}
+
+	d := &decodedFrame{
+		width:  int(frame.width),
+		height: int(frame.height),
+		depth:  uint(frame.bit_depth),
+		color:  color,
+	}
+	switch frame.subsampling {
+	case C.AVIF_SUBSAMPLING_I420:
+		d.sx, d.sy = 1, 1
+	case C.AVIF_SUBSAMPLING_I422:
+		d.sx = 1
+	case C.AVIF_SUBSAMPLING_I400:
+		d.monochrome = true
+	}
+	cw := (d.width + 1<<d.sx - 1) >> d.sx
+	ch := (d.height + 1<<d.sy - 1) >> d.sy
+	size := d.width * d.height
+	if !d.monochrome {
+		size += cw * ch * 2
+	}
+	pix := make([]uint16, size)
+	if d.depth > 8 {
+		copy(pix, unsafe.Slice((*uint16)(unsafe.Pointer(frame.data)), size))
+	} else {
+		for i, v := range unsafe.Slice((*byte)(unsafe.Pointer(frame.data)), size) {
+			pix[i] = uint16(v)
+		}
+	}
+	d.y = plane{d.width, d.height, pix[:d.width*d.height]}
+	if !d.monochrome {
+		pix = pix[d.width*d.height:]
+		d.u = plane{cw, ch, pix[:cw*ch]}
+		d.v = plane{cw, ch, pix[cw*ch:]}
+	}
+	return d, nil
+}
+
+// Decode image item, either coded image or grid of tiles.
+func (f *demuxedFile) decodeItem(id uint16) (*decodedFrame, error) {
+	if err := f.checkEssential(id); err != nil {
+		return nil, err
+	}
+	data, err := f.itemData(id)
+	if err != nil {
+		return nil, err
+	}
+	switch f.item(id).itemType {
+	case itemTypeAV01:
+		return decodeFrame(data)
+	case itemTypeGRID:
+		return f.decodeGrid(id, data)
+	}
+	return nil, DemuxerError("unsupported item type")
+}
+
+// Decode tiles of the grid and combine them into a single frame.
+func (f *demuxedFile) decodeGrid(id uint16, data []byte) (*decodedFrame, error) {
+	r := &byteReader{buf: data}
+	version := r.u8()
+	flags := r.u8()
+	rows := int(r.u8()) + 1
+	columns := int(r.u8()) + 1
+	var width, height uint32
+	if flags&1 != 0 {
+		width, height = r.u32(), r.u32()
+	} else {
+		width, height = uint32(r.u16()), uint32(r.u16())
+	}
+	if r.err != nil || version != 0 || width == 0 || height == 0 {
+		return nil, DemuxerError("bad grid")
+	}
+	tileIDs := f.references(refTypeDIMG, id)
+	if len(tileIDs) != rows*columns {
+		return nil, DemuxerError("bad grid tile count")
+	}
+	var grid *decodedFrame
+	for i, tileID := range tileIDs {
+		if info := f.item(tileID); info == nil || info.itemType != itemTypeAV01 {
+			return nil, DemuxerError("unsupported grid tile")
+		}
+		tile, err := f.decodeItem(tileID)
+		if err != nil {
+			return nil, err
+		}
+		if grid == nil {
+			// Tiles of subsampled image must start at chroma sample.
+			if columns*tile.width < int(width) || rows*tile.height < int(height) ||
+				tile.width&(1<<tile.sx-1) != 0 || tile.height&(1<<tile.sy-1) != 0 {
+				return nil, DemuxerError("bad grid tile size")
+			}
+			grid = &decodedFrame{
+				width:      int(width),
+				height:     int(height),
+				depth:      tile.depth,
+				monochrome: tile.monochrome,
+				color:      tile.color,
+				sx:         tile.sx,
+				sy:         tile.sy,
+			}
+			newPlane := func(p plane) plane {
+				w, h := p.width*columns, p.height*rows
+				return plane{w, h, make([]uint16, w*h)}
+			}
+			grid.y = newPlane(tile.y)
+			if !grid.monochrome {
+				grid.u = newPlane(tile.u)
+				grid.v = newPlane(tile.v)
+			}
+		} else if tile.width != grid.y.width/columns || tile.height != grid.y.height/rows ||
+			tile.depth != grid.depth || tile.monochrome != grid.monochrome ||
+			tile.sx != grid.sx || tile.sy != grid.sy {
+			return nil, DemuxerError("grid tiles mismatch")
+		}
+		x, y := i%columns, i/columns
+		grid.y.paste(tile.y, x*tile.y.width, y*tile.y.height)
+		if !grid.monochrome {
+			grid.u.paste(tile.u, x*tile.u.width, y*tile.u.height)
+			grid.v.paste(tile.v, x*tile.v.width, y*tile.v.height)
+		}
+	}
+	return grid, nil
+}
+
+// Return normalized sample value, luma in [0, 1] and chroma in
+// [-0.5, 0.5] ranges.
+func (d *decodedFrame) normalize(v uint16, chroma bool) float32 {
+	mul := float32(uint32(1) << (d.depth - 8))
+	if d.color.full_range != 0 {
+		max := float32(uint32(1)<<d.depth - 1)
+		if chroma {
+			return (float32(v) - 128*mul) / max
+		}
+		return float32(v) / max
+	}
+	if chroma {
+		return (float32(v) - 128*mul) / (224 * mul)
+	}
+	return (float32(v) - 16*mul) / (219 * mul)
+}
+
+// Get luma coefficients of the matrix.
+func getKrKb(matrixCoefficients int) (float32, float32) {
+	switch matrixCoefficients {
+	case 5, 6: // BT.601
+		return 0.299, 0.114
+	case 9, 10: // BT.2020
+		return 0.2627, 0.0593
+	}
+	// BT.709, also used for unspecified since it's what we encode.
+	return 0.2126, 0.0722
+}
+
+func clamp16(v float32) uint16 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 1 {
+		return 0xffff
+	}
+	return uint16(v*0xffff + 0.5)
+}
+
+// Convert pixel at the given position to 16-bit RGB.
+func (d *decodedFrame) rgb(x, y int, kr, kb float32) (uint16, uint16, uint16) {
+	luma := d.normalize(d.y.at(x, y), false)
+	if d.monochrome {
+		v := clamp16(luma)
+		return v, v, v
+	}
+	// TODO(Kagami): Upsample chroma planes with some better filter.
+	cx, cy := x>>d.sx, y>>d.sy
+	if d.color.matrix_coefficients == 0 {
+		// Identity matrix, planes are stored as GBR.
+		b := d.normalize(d.u.at(cx, cy), false)
+		r := d.normalize(d.v.at(cx, cy), false)
+		return clamp16(r), clamp16(luma), clamp16(b)
+	}
+	cb := d.normalize(d.u.at(cx, cy), true)
+	cr := d.normalize(d.v.at(cx, cy), true)
+	r := luma + 2*(1-kr)*cr
+	b := luma + 2*(1-kb)*cb
+	g := (luma - kr*r - kb*b) / (1 - kr - kb)
+	return clamp16(r), clamp16(g), clamp16(b)
+}
+
+// Convert decoded frames to Go image of the most appropriate type
+// applying the transform.
+func convertFrame(d *decodedFrame, alpha *decodedFrame, t *transform) image.Image {
+	rec := image.Rect(0, 0, t.width, t.height)
+	kr, kb := getKrKb(int(d.color.matrix_coefficients))
+	switch {
+	case alpha == nil && d.monochrome && d.depth == 8:
+		m := image.NewGray(rec)
+		for y := t.rec.Min.Y; y < t.rec.Max.Y; y++ {
+			for x := t.rec.Min.X; x < t.rec.Max.X; x++ {
+				dx, dy := t.apply(x, y)
+				v, _, _ := d.rgb(x, y, kr, kb)
+				m.Pix[dy*m.Stride+dx] = uint8(v >> 8)
+			}
+		}
+		return m
+	case alpha == nil && d.monochrome:
+		m := image.NewGray16(rec)
+		for y := t.rec.Min.Y; y < t.rec.Max.Y; y++ {
+			for x := t.rec.Min.X; x < t.rec.Max.X; x++ {
+				dx, dy := t.apply(x, y)
+				v, _, _ := d.rgb(x, y, kr, kb)
+				m.SetGray16(dx, dy, color.Gray16{v})
+			}
+		}
+		return m
+	case alpha == nil && d.depth == 8:
+		m := image.NewRGBA(rec)
+		for y := t.rec.Min.Y; y < t.rec.Max.Y; y++ {
+			for x := t.rec.Min.X; x < t.rec.Max.X; x++ {
+				dx, dy := t.apply(x, y)
+				r, g, b := d.rgb(x, y, kr, kb)
+				i := dy*m.Stride + dx*4
+				m.Pix[i+0] = uint8(r >> 8)
+				m.Pix[i+1] = uint8(g >> 8)
+				m.Pix[i+2] = uint8(b >> 8)
+				m.Pix[i+3] = 0xff
+			}
+		}
+		return m
+	case alpha == nil:
+		m := image.NewRGBA64(rec)
+		for y := t.rec.Min.Y; y < t.rec.Max.Y; y++ {
+			for x := t.rec.Min.X; x < t.rec.Max.X; x++ {
+				dx, dy := t.apply(x, y)
+				r, g, b := d.rgb(x, y, kr, kb)
+				m.SetRGBA64(dx, dy, color.RGBA64{r, g, b, 0xffff})
+			}
+		}
+		return m
+	case d.depth == 8:
+		m := image.NewNRGBA(rec)
+		for y := t.rec.Min.Y; y < t.rec.Max.Y; y++ {
+			for x := t.rec.Min.X; x < t.rec.Max.X; x++ {
+				dx, dy := t.apply(x, y)
+				r, g, b := d.rgb(x, y, kr, kb)
+				a := clamp16(alpha.normalize(alpha.y.at(x, y), false))
+				i := dy*m.Stride + dx*4
+				m.Pix[i+0] = uint8(r >> 8)
+				m.Pix[i+1] = uint8(g >> 8)
+				m.Pix[i+2] = uint8(b >> 8)
+				m.Pix[i+3] = uint8(a >> 8)
+			}
+		}
+		return m
+	default:
+		m := image.NewNRGBA64(rec)
+		for y := t.rec.Min.Y; y < t.rec.Max.Y; y++ {
+			for x := t.rec.Min.X; x < t.rec.Max.X; x++ {
+				dx, dy := t.apply(x, y)
+				r, g, b := d.rgb(x, y, kr, kb)
+				a := clamp16(alpha.normalize(alpha.y.at(x, y), false))
+				m.SetNRGBA64(dx, dy, color.NRGBA64{r, g, b, a})
+			}
+		}
+		return m
+	}
+}
+
+//----------------------------------------------------------------------
+
+func readAll(r io.Reader) (*demuxedFile, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return demux(data)
+}
+
+// Decode reads an AVIF image from r and returns it as an image.Image.
+// Only the primary image item along with its alpha channel is decoded,
+// either of which may be a grid of tiles.
+// Clean aperture, rotation and mirroring of the image are applied.
+// Subsampled chroma is upsampled with nearest neighbour, ignoring the
+// chroma sample position.
+func Decode(r io.Reader) (image.Image, error) {
+	f, err := readAll(r)
+	if err != nil {
+		return nil, err
+	}
+	d, err := f.decodeItem(f.primaryID())
+	if err != nil {
+		return nil, err
+	}
+	// Colour information of the container takes precedence over the
+	// bitstream one.
+	if colr := f.nclx(f.primaryID()); colr != nil {
+		d.color.matrix_coefficients = C.int(colr.matrixCoefficients)
+		d.color.full_range = 0
+		if colr.fullRangeFlag {
+			d.color.full_range = 1
+		}
+	}
+
+	var alpha *decodedFrame
+	if alphaID := f.alphaID(f.primaryID()); alphaID != 0 {
+		if alpha, err = f.decodeItem(alphaID); err != nil {
+			return nil, err
+		}
+		if alpha.width != d.width || alpha.height != d.height {
+			return nil, DemuxerError("alpha size mismatch")
+		}
+	}
+
+	// Alpha plane is transformed the same way as the image.
+	t, err := f.transform(f.primaryID(), d.width, d.height)
+	if err != nil {
+		return nil, err
+	}
+	return convertFrame(d, alpha, t), nil
+}
+
+// DecodeConfig returns the color model and dimensions of an AVIF image
+// without decoding the entire image.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	f, err := readAll(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	ispe, _ := f.itemProperty(f.primaryID(), boxTypeISPE).(*boxISPE)
+	av1C := f.av1Config(f.primaryID())
+	if ispe == nil || av1C == nil {
+		return image.Config{}, DemuxerError("missing image properties")
+	}
+	highBitdepth := av1C.av1Config.highBitdepth
+	monochrome := av1C.av1Config.monochrome
+	hasAlpha := f.alphaID(f.primaryID()) != 0
+
+	var model color.Model
+	switch {
+	case !hasAlpha && monochrome && !highBitdepth:
+		model = color.GrayModel
+	case !hasAlpha && monochrome:
+		model = color.Gray16Model
+	case !hasAlpha && !highBitdepth:
+		model = color.RGBAModel
+	case !hasAlpha:
+		model = color.RGBA64Model
+	case !highBitdepth:
+		model = color.NRGBAModel
+	default:
+		model = color.NRGBA64Model
+	}
+	t, err := f.transform(f.primaryID(), int(ispe.imageWidth), int(ispe.imageHeight))
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{
+		ColorModel: model,
+		Width:      t.width,
+		Height:     t.height,
+	}, nil
+}
@@ -0,0 +1,86 @@
+package avif
+
+import (
+	"image"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	const w, h = 3, 2
+	// Transformations CLI uses for EXIF orientations, along with the
+	// mapping of the orientation.
+	tests := []struct {
+		rotation uint8
+		axis     int
+		want     func(x, y int) (int, int)
+	}{
+		{0, 0, func(x, y int) (int, int) { return w - 1 - x, y }},
+		{2, -1, func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }},
+		{0, 1, func(x, y int) (int, int) { return x, h - 1 - y }},
+		{1, 1, func(x, y int) (int, int) { return y, x }},
+		{3, -1, func(x, y int) (int, int) { return h - 1 - y, x }},
+		{1, 0, func(x, y int) (int, int) { return h - 1 - y, w - 1 - x }},
+		{1, -1, func(x, y int) (int, int) { return y, w - 1 - x }},
+	}
+	for i, test := range tests {
+		tr := newTransform(w, h)
+		for n := uint8(0); n < test.rotation; n++ {
+			tr.rotate()
+		}
+		if test.axis >= 0 {
+			tr.mirror(uint8(test.axis))
+		}
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				gx, gy := tr.apply(x, y)
+				wx, wy := test.want(x, y)
+				if gx != wx || gy != wy {
+					t.Errorf("orientation %d: (%d, %d) mapped to (%d, %d), want (%d, %d)",
+						i+2, x, y, gx, gy, wx, wy)
+				}
+			}
+		}
+	}
+}
+
+func TestTransformCrop(t *testing.T) {
+	// Crop 3x2 region of 4x3 frame, then rotate.
+	tr := newTransform(4, 3)
+	tr.crop(image.Rect(1, 1, 4, 3))
+	tr.rotate()
+	if tr.width != 2 || tr.height != 3 || tr.rec != image.Rect(1, 1, 4, 3) {
+		t.Fatalf("got %dx%d of %v", tr.width, tr.height, tr.rec)
+	}
+	if x, y := tr.apply(1, 1); x != 0 || y != 2 {
+		t.Errorf("(1, 1) mapped to (%d, %d), want (0, 2)", x, y)
+	}
+	// Crop of the rotated image maps back to the frame.
+	tr = newTransform(4, 3)
+	tr.rotate()
+	tr.crop(image.Rect(0, 0, 3, 1))
+	if tr.width != 3 || tr.height != 1 || tr.rec != image.Rect(3, 0, 4, 3) {
+		t.Fatalf("got %dx%d of %v", tr.width, tr.height, tr.rec)
+	}
+	if x, y := tr.apply(3, 2); x != 2 || y != 0 {
+		t.Errorf("(3, 2) mapped to (%d, %d), want (2, 0)", x, y)
+	}
+}
+
+func TestCheckFTYP(t *testing.T) {
+	tests := []struct {
+		major      fourCC
+		compatible []fourCC
+		ok         bool
+	}{
+		{itemTypeAVIF, nil, true},
+		{itemTypeMIF1, []fourCC{itemTypeMIF1, itemTypeAVIF}, true},
+		{itemTypeMIAF, []fourCC{itemTypeMIAF, itemTypeAVIF}, true},
+		{itemTypeMIF1, []fourCC{itemTypeMIF1, {'h', 'e', 'i', 'c'}}, false},
+	}
+	for _, test := range tests {
+		err := checkFTYP(&boxFTYP{majorBrand: test.major, compatibleBrands: test.compatible})
+		if (err == nil) != test.ok {
+			t.Errorf("%s %s: got %v", test.major, test.compatible, err)
+		}
+	}
+}
@@ -40,3 +40,33 @@ func Example() {
 
 	log.Printf("Encoded AVIF at %s", dstPath)
 }
+
+func ExampleEncoder() {
+	enc, err := avif.NewEncoder(&avif.Options{Speed: 8, Quality: 30})
+	if err != nil {
+		log.Fatalf("Bad encoder options: %v", err)
+	}
+	defer enc.Close()
+
+	for _, srcPath := range os.Args[1:] {
+		src, err := os.Open(srcPath)
+		if err != nil {
+			log.Fatalf("Can't open sorce file: %v", err)
+		}
+		img, _, err := image.Decode(src)
+		src.Close()
+		if err != nil {
+			log.Fatalf("Can't decode source file: %v", err)
+		}
+
+		dst, err := os.Create(srcPath + ".avif")
+		if err != nil {
+			log.Fatalf("Can't create destination file: %v", err)
+		}
+		err = enc.Encode(dst, img)
+		dst.Close()
+		if err != nil {
+			log.Fatalf("Can't encode source image: %v", err)
+		}
+	}
+}
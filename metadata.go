@@ -0,0 +1,252 @@
+package avif
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+)
+
+// Limit of decompressed ICC profile, real ones are way smaller.
+const maxICCSize = 4 << 20
+
+const (
+	jpegMarkerSOI  = 0xd8
+	jpegMarkerSOS  = 0xda
+	jpegMarkerEOI  = 0xd9
+	jpegMarkerAPP1 = 0xe1
+	jpegMarkerAPP2 = 0xe2
+)
+
+var (
+	exifHeader       = []byte("Exif\x00\x00")
+	jpegXMPSignature = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegICCSignature = []byte("ICC_PROFILE\x00")
+	pngSignature     = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// Iterate over JPEG marker segments preceding the image data.
+func readJPEGSegments(data []byte, fn func(marker byte, payload []byte) error) error {
+	if len(data) < 2 || data[0] != 0xff || data[1] != jpegMarkerSOI {
+		return MetadataError("not a JPEG file")
+	}
+	data = data[2:]
+	for {
+		// Markers may be preceded by any number of fill bytes.
+		i := 0
+		for i < len(data) && data[i] == 0xff {
+			i++
+		}
+		if i == 0 || i >= len(data) {
+			return MetadataError("bad JPEG marker")
+		}
+		marker := data[i]
+		data = data[i+1:]
+		if marker == jpegMarkerSOS || marker == jpegMarkerEOI {
+			return nil
+		}
+		if marker >= 0xd0 && marker <= 0xd7 || marker == 0x01 {
+			// Standalone markers without payload.
+			continue
+		}
+		if len(data) < 2 {
+			return MetadataError("truncated JPEG segment")
+		}
+		size := int(binary.BigEndian.Uint16(data))
+		if size < 2 || size > len(data) {
+			return MetadataError("bad JPEG segment size")
+		}
+		if err := fn(marker, data[2:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+}
+
+// ICCFromJPEG extracts ICC profile stored in APP2 segments of the JPEG
+// file. Returns nil if there is no profile.
+func ICCFromJPEG(data []byte) ([]byte, error) {
+	var chunks [][]byte
+	total := 0
+	err := readJPEGSegments(data, func(marker byte, payload []byte) error {
+		if marker != jpegMarkerAPP2 || !bytes.HasPrefix(payload, jpegICCSignature) {
+			return nil
+		}
+		payload = payload[len(jpegICCSignature):]
+		if len(payload) < 2 {
+			return MetadataError("truncated ICC chunk")
+		}
+		seqNo, count := int(payload[0]), int(payload[1])
+		if chunks == nil {
+			chunks = make([][]byte, count)
+		}
+		if seqNo < 1 || seqNo > len(chunks) || count != len(chunks) || chunks[seqNo-1] != nil {
+			return MetadataError("bad ICC chunk number")
+		}
+		chunks[seqNo-1] = payload[2:]
+		total += len(payload) - 2
+		return nil
+	})
+	if err != nil || chunks == nil {
+		return nil, err
+	}
+	profile := make([]byte, 0, total)
+	for _, c := range chunks {
+		if c == nil {
+			return nil, MetadataError("missing ICC chunk")
+		}
+		profile = append(profile, c...)
+	}
+	return profile, nil
+}
+
+// Return payload of the first segment with the given marker and
+// signature, without the signature.
+func findJPEGSegment(data []byte, marker byte, signature []byte) ([]byte, error) {
+	var found []byte
+	err := readJPEGSegments(data, func(m byte, payload []byte) error {
+		if found == nil && m == marker && bytes.HasPrefix(payload, signature) {
+			found = payload[len(signature):]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// ExifFromJPEG extracts EXIF data stored in APP1 segment of the JPEG
+// file. Data is returned in TIFF format, without the "Exif\0\0" header.
+// Returns nil if there is no EXIF data.
+func ExifFromJPEG(data []byte) ([]byte, error) {
+	return findJPEGSegment(data, jpegMarkerAPP1, exifHeader)
+}
+
+// XMPFromJPEG extracts XMP packet stored in APP1 segment of the JPEG
+// file. Extended XMP is not supported. Returns nil if there is no XMP
+// packet.
+func XMPFromJPEG(data []byte) ([]byte, error) {
+	return findJPEGSegment(data, jpegMarkerAPP1, jpegXMPSignature)
+}
+
+// ExifOrientation returns value of the Orientation tag of EXIF data in
+// TIFF format, possibly prefixed by "Exif\0\0" header. Returns 0 if
+// there is no such tag.
+func ExifOrientation(exif []byte) (int, error) {
+	order, value, err := findExifOrientation(exif)
+	if value == nil {
+		return 0, err
+	}
+	return int(order.Uint16(value)), nil
+}
+
+// ResetExifOrientation returns copy of EXIF data with the Orientation tag
+// set to 1, so that viewers don't apply it on top of the transformations
+// signaled in the container. Data is returned as is if there is no such
+// tag.
+func ResetExifOrientation(exif []byte) ([]byte, error) {
+	exif = append([]byte(nil), exif...)
+	order, value, err := findExifOrientation(exif)
+	if value != nil {
+		order.PutUint16(value, 1)
+	}
+	return exif, err
+}
+
+// Return byte order of EXIF data and value of its Orientation tag, nil if
+// there is no such tag.
+func findExifOrientation(exif []byte) (binary.ByteOrder, []byte, error) {
+	exif = bytes.TrimPrefix(exif, exifHeader)
+	if len(exif) < 8 {
+		return nil, nil, MetadataError("truncated TIFF header")
+	}
+	var order binary.ByteOrder
+	switch string(exif[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, nil, MetadataError("bad TIFF header")
+	}
+	ifd := uint64(order.Uint32(exif[4:]))
+	if ifd+2 > uint64(len(exif)) {
+		return nil, nil, MetadataError("bad IFD offset")
+	}
+	count := uint64(order.Uint16(exif[ifd:]))
+	entries := exif[ifd+2:]
+	if count*12 > uint64(len(entries)) {
+		return nil, nil, MetadataError("truncated IFD")
+	}
+	for i := uint64(0); i < count; i++ {
+		e := entries[i*12 : i*12+12]
+		// Orientation is a single SHORT stored in place.
+		if order.Uint16(e) == 0x0112 {
+			if order.Uint16(e[2:]) != 3 || order.Uint32(e[4:]) != 1 {
+				return nil, nil, MetadataError("bad orientation tag")
+			}
+			return order, e[8:10], nil
+		}
+	}
+	return order, nil, nil
+}
+
+// Iterate over PNG chunks preceding the image data.
+func readPNGChunks(data []byte, fn func(typ string, payload []byte) error) error {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return MetadataError("not a PNG file")
+	}
+	data = data[len(pngSignature):]
+	for {
+		if len(data) < 8 {
+			return MetadataError("truncated PNG chunk")
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		typ := string(data[4:8])
+		if typ == "IDAT" || typ == "IEND" {
+			return nil
+		}
+		// Payload is followed by CRC.
+		if size+12 > uint64(len(data)) {
+			return MetadataError("bad PNG chunk size")
+		}
+		if err := fn(typ, data[8:8+size]); err != nil {
+			return err
+		}
+		data = data[12+size:]
+	}
+}
+
+// ICCFromPNG extracts ICC profile stored in iCCP chunk of the PNG file.
+// Returns nil if there is no profile.
+func ICCFromPNG(data []byte) ([]byte, error) {
+	var profile []byte
+	err := readPNGChunks(data, func(typ string, payload []byte) error {
+		if typ != "iCCP" {
+			return nil
+		}
+		// Profile name is followed by compression method.
+		i := bytes.IndexByte(payload, 0)
+		if i < 0 || i+1 >= len(payload) || payload[i+1] != 0 {
+			return MetadataError("bad iCCP chunk")
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(payload[i+2:]))
+		if err != nil {
+			return MetadataError("bad ICC profile compression")
+		}
+		defer zr.Close()
+		if profile, err = ioutil.ReadAll(io.LimitReader(zr, maxICCSize+1)); err != nil {
+			return MetadataError("bad ICC profile compression")
+		}
+		if len(profile) > maxICCSize {
+			return MetadataError("ICC profile is too large")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
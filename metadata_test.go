@@ -0,0 +1,151 @@
+package avif
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	b := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(payload)+2))
+	return append(b, payload...)
+}
+
+func pngChunk(typ string, payload []byte) []byte {
+	b := make([]byte, 8, 12+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(len(payload)))
+	copy(b[4:], typ)
+	b = append(b, payload...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(b[4:]))
+	return append(b, crc...)
+}
+
+func TestICCFromJPEG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if icc, err := ICCFromJPEG(data); icc != nil || err != nil {
+		t.Fatalf("got %q, %v; want no profile", icc, err)
+	}
+	// Chunks may be stored in any order.
+	var src []byte
+	src = append(src, data[:2]...)
+	src = append(src, jpegSegment(jpegMarkerAPP2, append([]byte("ICC_PROFILE\x00\x02\x02"), "world"...))...)
+	src = append(src, jpegSegment(jpegMarkerAPP2, append([]byte("ICC_PROFILE\x00\x01\x02"), "hello "...))...)
+	src = append(src, data[2:]...)
+	icc, err := ICCFromJPEG(src)
+	if err != nil || string(icc) != "hello world" {
+		t.Fatalf("got %q, %v", icc, err)
+	}
+	if _, err := ICCFromJPEG(src[:len(data[:2])+10]); err == nil {
+		t.Fatal("truncated file accepted")
+	}
+}
+
+func TestICCFromPNG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if icc, err := ICCFromPNG(data); icc != nil || err != nil {
+		t.Fatalf("got %q, %v; want no profile", icc, err)
+	}
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write([]byte("hello world"))
+	zw.Close()
+	// iCCP goes right after IHDR.
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	var src []byte
+	src = append(src, data[:ihdrEnd]...)
+	src = append(src, pngChunk("iCCP", append([]byte("name\x00\x00"), z.Bytes()...))...)
+	src = append(src, data[ihdrEnd:]...)
+	if _, err := png.Decode(bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	icc, err := ICCFromPNG(src)
+	if err != nil || string(icc) != "hello world" {
+		t.Fatalf("got %q, %v", icc, err)
+	}
+	// Decompressed size is limited.
+	z.Reset()
+	zw.Reset(&z)
+	zw.Write(make([]byte, maxICCSize+1))
+	zw.Close()
+	src = append([]byte(nil), data[:ihdrEnd]...)
+	src = append(src, pngChunk("iCCP", append([]byte("name\x00\x00"), z.Bytes()...))...)
+	src = append(src, data[ihdrEnd:]...)
+	if icc, err := ICCFromPNG(src); err == nil {
+		t.Errorf("got profile of %d bytes, want error", len(icc))
+	}
+}
+
+func TestExifXMPFromJPEG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	var src []byte
+	src = append(src, data[:2]...)
+	src = append(src, jpegSegment(jpegMarkerAPP1, append([]byte("Exif\x00\x00"), "II*\x00"...))...)
+	src = append(src, jpegSegment(jpegMarkerAPP1, append([]byte("http://ns.adobe.com/xap/1.0/\x00"), "<x/>"...))...)
+	src = append(src, data[2:]...)
+	if exif, err := ExifFromJPEG(src); err != nil || string(exif) != "II*\x00" {
+		t.Errorf("got %q, %v", exif, err)
+	}
+	if xmp, err := XMPFromJPEG(src); err != nil || string(xmp) != "<x/>" {
+		t.Errorf("got %q, %v", xmp, err)
+	}
+	if exif, err := ExifFromJPEG(data); exif != nil || err != nil {
+		t.Errorf("got %q, %v; want no EXIF", exif, err)
+	}
+}
+
+func TestExifOrientation(t *testing.T) {
+	for _, exif := range [][]byte{
+		[]byte("II*\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00\x06\x00\x00\x00"),
+		[]byte("Exif\x00\x00MM\x00*\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00"),
+	} {
+		if o, err := ExifOrientation(exif); o != 6 || err != nil {
+			t.Errorf("got %d, %v; want 6", o, err)
+		}
+	}
+	if o, err := ExifOrientation([]byte("II*\x00\x08\x00\x00\x00\x00\x00")); o != 0 || err != nil {
+		t.Errorf("got %d, %v; want no orientation", o, err)
+	}
+}
+
+func TestResetExifOrientation(t *testing.T) {
+	for _, exif := range [][]byte{
+		[]byte("II*\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00\x06\x00\x00\x00"),
+		[]byte("Exif\x00\x00MM\x00*\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00"),
+	} {
+		src := append([]byte(nil), exif...)
+		reset, err := ResetExifOrientation(exif)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o, err := ExifOrientation(reset); o != 1 || err != nil {
+			t.Errorf("got %d, %v; want 1", o, err)
+		}
+		// Only the value is changed, source is left as is.
+		if len(reset) != len(exif) || !bytes.Equal(exif, src) {
+			t.Errorf("got %q from %q", reset, exif)
+		}
+	}
+	exif := []byte("II*\x00\x08\x00\x00\x00\x00\x00")
+	if reset, err := ResetExifOrientation(exif); !bytes.Equal(reset, exif) || err != nil {
+		t.Errorf("got %q, %v; want %q", reset, err, exif)
+	}
+}
@@ -1,9 +1,12 @@
 package avif
 
 import (
+	"bytes"
 	"encoding/binary"
 	"image"
 	"io"
+	"io/ioutil"
+	"math"
 )
 
 type fourCC [4]byte
@@ -24,6 +27,12 @@ var (
 	boxTypeAV1C = fourCC{'a', 'v', '1', 'C'}
 	boxTypePIXI = fourCC{'p', 'i', 'x', 'i'}
 	boxTypeIPMA = fourCC{'i', 'p', 'm', 'a'}
+	boxTypeIREF = fourCC{'i', 'r', 'e', 'f'}
+	boxTypeAUXC = fourCC{'a', 'u', 'x', 'C'}
+	boxTypeCOLR = fourCC{'c', 'o', 'l', 'r'}
+	boxTypeCLAP = fourCC{'c', 'l', 'a', 'p'}
+	boxTypeIROT = fourCC{'i', 'r', 'o', 't'}
+	boxTypeIMIR = fourCC{'i', 'm', 'i', 'r'}
 
 	itemTypeMIF1 = fourCC{'m', 'i', 'f', '1'}
 	itemTypeAVIF = fourCC{'a', 'v', 'i', 'f'}
@@ -32,8 +41,21 @@ var (
 	itemTypeMIME = fourCC{'m', 'i', 'm', 'e'}
 	itemTypeURI  = fourCC{'u', 'r', 'i', ' '}
 	itemTypeAV01 = fourCC{'a', 'v', '0', '1'}
+	itemTypeEXIF = fourCC{'E', 'x', 'i', 'f'}
+	itemTypeGRID = fourCC{'g', 'r', 'i', 'd'}
+
+	refTypeAUXL = fourCC{'a', 'u', 'x', 'l'}
+	refTypeCDSC = fourCC{'c', 'd', 's', 'c'}
+	refTypeDIMG = fourCC{'d', 'i', 'm', 'g'}
+
+	colourTypeNCLX = fourCC{'n', 'c', 'l', 'x'}
+	colourTypePROF = fourCC{'p', 'r', 'o', 'f'}
 )
 
+const auxTypeAlpha = "urn:mpeg:mpegB:cicp:systems:auxiliary:alpha"
+
+const contentTypeXMP = "application/rdf+xml"
+
 func ulen(s string) uint32 {
 	return uint32(len(s))
 }
@@ -82,6 +104,12 @@ func (b *box) WriteTo(w io.Writer) (n int64, err error) {
 	return
 }
 
+// Type is only known for parsed boxes and for boxes written at least
+// once.
+func (b *box) Type() fourCC {
+	return b.typ
+}
+
 //----------------------------------------------------------------------
 
 type fullBox struct {
@@ -105,6 +133,33 @@ func (b *fullBox) WriteTo(w io.Writer) (n int64, err error) {
 
 //----------------------------------------------------------------------
 
+type anyBox interface {
+	io.WriterTo
+	Size() uint32
+	Type() fourCC
+}
+
+// Box of unknown type, payload is stored as is
+type boxUnknown struct {
+	box
+	data []byte
+}
+
+func (b *boxUnknown) Size() uint32 {
+	return b.box.Size() + uint32(len(b.data))
+}
+
+func (b *boxUnknown) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	if _, err = b.box.WriteTo(w); err != nil {
+		return
+	}
+	_, err = w.Write(b.data)
+	return
+}
+
+//----------------------------------------------------------------------
+
 // File Type Box
 type boxFTYP struct {
 	box
@@ -159,12 +214,21 @@ type boxMETA struct {
 	primaryResource boxPITM
 	itemLocations   boxILOC
 	itemInfos       boxIINF
+	itemRefs        *boxIREF // optional
 	itemProps       boxIPRP
+	other           []anyBox
 }
 
 func (b *boxMETA) Size() uint32 {
-	return b.fullBox.Size() + b.theHandler.Size() + b.primaryResource.Size() +
+	size := b.fullBox.Size() + b.theHandler.Size() + b.primaryResource.Size() +
 		b.itemLocations.Size() + b.itemInfos.Size() + b.itemProps.Size()
+	if b.itemRefs != nil {
+		size += b.itemRefs.Size()
+	}
+	for _, o := range b.other {
+		size += o.Size()
+	}
+	return size
 }
 
 func (b *boxMETA) WriteTo(w io.Writer) (n int64, err error) {
@@ -174,7 +238,23 @@ func (b *boxMETA) WriteTo(w io.Writer) (n int64, err error) {
 		return
 	}
 	err = writeAll(w, &b.theHandler, &b.primaryResource, &b.itemLocations,
-		&b.itemInfos, &b.itemProps)
+		&b.itemInfos)
+	if err != nil {
+		return
+	}
+	if b.itemRefs != nil {
+		if _, err = b.itemRefs.WriteTo(w); err != nil {
+			return
+		}
+	}
+	if _, err = b.itemProps.WriteTo(w); err != nil {
+		return
+	}
+	for _, o := range b.other {
+		if _, err = o.WriteTo(w); err != nil {
+			return
+		}
+	}
 	return
 }
 
@@ -187,12 +267,13 @@ type boxHDLR struct {
 	handlerType fourCC
 	reserved    [3]uint32
 	name        string
+	trailing    []byte // after the name, kept as is
 }
 
 func (b *boxHDLR) Size() uint32 {
 	return b.fullBox.Size() +
 		4 /*pre_defined*/ + 4 /*handler_type*/ + 12 /*reserved*/ +
-		ulen(b.name) + 1 /*\0*/
+		ulen(b.name) + 1 /*\0*/ + uint32(len(b.trailing))
 }
 
 func (b *boxHDLR) WriteTo(w io.Writer) (n int64, err error) {
@@ -201,7 +282,7 @@ func (b *boxHDLR) WriteTo(w io.Writer) (n int64, err error) {
 	if _, err = b.fullBox.WriteTo(w); err != nil {
 		return
 	}
-	err = writeBE(w, b.preDefined, b.handlerType, b.reserved, []byte(b.name), []byte{0})
+	err = writeBE(w, b.preDefined, b.handlerType, b.reserved, []byte(b.name), []byte{0}, b.trailing)
 	return
 }
 
@@ -235,17 +316,23 @@ type boxILOC struct {
 	offsetSize     uint8 // 4 bits
 	lengthSize     uint8 // 4 bits
 	baseOffsetSize uint8 // 4 bits
-	reserved       uint8 // 4 bits
+	indexSize      uint8 // 4 bits, reserved in version 0
 	itemCount      uint16
 	items          []boxILOCItem
 }
 
 func (b *boxILOC) Size() uint32 {
 	size := b.fullBox.Size() + 1 /*offset_size + length_size*/ +
-		1 /*base_offset_size + reserved*/ + 2 /*item_count*/
+		1 /*base_offset_size + index_size/reserved*/ + 2 /*item_count*/
+	itemSize := 2 /*item_ID*/ + 2 /*data_reference_index*/ + uint32(b.baseOffsetSize) +
+		2 /*extent_count*/
+	extentSize := uint32(b.offsetSize + b.lengthSize)
+	if b.version >= 1 {
+		itemSize += 2 /*reserved + construction_method*/
+		extentSize += uint32(b.indexSize)
+	}
 	for _, i := range b.items {
-		size += 2 /*item_ID*/ + 2 /*data_reference_index*/ + uint32(b.baseOffsetSize) +
-			2 /*extent_count*/ + uint32(len(i.extents))*uint32(b.offsetSize+b.lengthSize)
+		size += itemSize + uint32(len(i.extents))*extentSize
 	}
 	return size
 }
@@ -257,14 +344,17 @@ func (b *boxILOC) WriteTo(w io.Writer) (n int64, err error) {
 	if _, err = b.fullBox.WriteTo(w); err != nil {
 		return
 	}
+	if b.version == 0 {
+		b.indexSize = 0
+	}
 	offsetSizeAndLengthSize := (b.offsetSize << 4) | (b.lengthSize & 0xf)
-	baseOffsetSizeAndReserved := (b.baseOffsetSize << 4) | (b.reserved & 0xf)
-	err = writeBE(w, offsetSizeAndLengthSize, baseOffsetSizeAndReserved, b.itemCount)
+	baseOffsetSizeAndIndexSize := (b.baseOffsetSize << 4) | (b.indexSize & 0xf)
+	err = writeBE(w, offsetSizeAndLengthSize, baseOffsetSizeAndIndexSize, b.itemCount)
 	if err != nil {
 		return
 	}
 	for _, i := range b.items {
-		err = i.write(w, b.baseOffsetSize, b.offsetSize, b.lengthSize)
+		err = i.write(w, b.version, b.baseOffsetSize, b.indexSize, b.offsetSize, b.lengthSize)
 		if err != nil {
 			return
 		}
@@ -272,29 +362,43 @@ func (b *boxILOC) WriteTo(w io.Writer) (n int64, err error) {
 	return
 }
 
+// Return value of 0, 32 or 64 bits.
+func sizedValue(v uint64, size uint8) interface{} {
+	if size == 4 {
+		return uint32(v)
+	} else if size == 8 {
+		return v
+	}
+	return []byte{}
+}
+
 type boxILOCItem struct {
 	itemID             uint16
+	constructionMethod uint8 // 4 bits, version 1 only
 	dataReferenceIndex uint16
 	baseOffset         uint64 // 0, 32 or 64 bits
 	extentCount        uint16
 	extents            []boxILOCItemExtent
 }
 
-func (i *boxILOCItem) write(w io.Writer, baseOffsetSize, offsetSize, lengthSize uint8) (err error) {
+func (i *boxILOCItem) write(w io.Writer, version, baseOffsetSize, indexSize, offsetSize, lengthSize uint8) (err error) {
 	i.extentCount = uint16(len(i.extents))
-	var baseOffset interface{}
-	baseOffset = []byte{}
-	if baseOffsetSize == 4 {
-		baseOffset = uint32(i.baseOffset)
-	} else if baseOffsetSize == 8 {
-		baseOffset = i.baseOffset
-	}
-	err = writeBE(w, i.itemID, i.dataReferenceIndex, baseOffset, i.extentCount)
+	if err = writeBE(w, i.itemID); err != nil {
+		return
+	}
+	if version >= 1 {
+		if err = writeBE(w, uint16(i.constructionMethod&0xf)); err != nil {
+			return
+		}
+	} else {
+		indexSize = 0
+	}
+	err = writeBE(w, i.dataReferenceIndex, sizedValue(i.baseOffset, baseOffsetSize), i.extentCount)
 	if err != nil {
 		return
 	}
 	for _, e := range i.extents {
-		if err = e.write(w, offsetSize, lengthSize); err != nil {
+		if err = e.write(w, indexSize, offsetSize, lengthSize); err != nil {
 			return
 		}
 	}
@@ -302,26 +406,14 @@ func (i *boxILOCItem) write(w io.Writer, baseOffsetSize, offsetSize, lengthSize
 }
 
 type boxILOCItemExtent struct {
+	extentIndex  uint64 // 0, 32 or 64 bits, version 1 only
 	extentOffset uint64 // 0, 32 or 64 bits
 	extentLength uint64 // 0, 32 or 64 bits
 }
 
-func (e *boxILOCItemExtent) write(w io.Writer, offsetSize, lengthSize uint8) (err error) {
-	var extentOffset interface{}
-	extentOffset = []byte{}
-	if offsetSize == 4 {
-		extentOffset = uint32(e.extentOffset)
-	} else if offsetSize == 8 {
-		extentOffset = e.extentOffset
-	}
-	var extentLength interface{}
-	extentLength = []byte{}
-	if lengthSize == 4 {
-		extentLength = uint32(e.extentLength)
-	} else if lengthSize == 8 {
-		extentLength = e.extentLength
-	}
-	err = writeBE(w, extentOffset, extentLength)
+func (e *boxILOCItemExtent) write(w io.Writer, indexSize, offsetSize, lengthSize uint8) (err error) {
+	err = writeBE(w, sizedValue(e.extentIndex, indexSize),
+		sizedValue(e.extentOffset, offsetSize), sizedValue(e.extentLength, lengthSize))
 	return
 }
 
@@ -332,6 +424,7 @@ type boxIINF struct {
 	fullBox
 	entryCount uint16
 	itemInfos  []boxINFEv2
+	other      []anyBox // entries of unsupported versions
 }
 
 func (b *boxIINF) Size() uint32 {
@@ -339,13 +432,16 @@ func (b *boxIINF) Size() uint32 {
 	for _, ie := range b.itemInfos {
 		size += ie.Size()
 	}
+	for _, o := range b.other {
+		size += o.Size()
+	}
 	return size
 }
 
 func (b *boxIINF) WriteTo(w io.Writer) (n int64, err error) {
 	b.size = b.Size()
 	b.typ = boxTypeIINF
-	b.entryCount = uint16(len(b.itemInfos))
+	b.entryCount = uint16(len(b.itemInfos) + len(b.other))
 	if _, err = b.fullBox.WriteTo(w); err != nil {
 		return
 	}
@@ -357,6 +453,11 @@ func (b *boxIINF) WriteTo(w io.Writer) (n int64, err error) {
 			return
 		}
 	}
+	for _, o := range b.other {
+		if _, err = o.WriteTo(w); err != nil {
+			return
+		}
+	}
 	return
 }
 
@@ -409,15 +510,73 @@ func (b *boxINFEv2) WriteTo(w io.Writer) (n int64, err error) {
 
 //----------------------------------------------------------------------
 
+// Item Reference Box
+type boxIREF struct {
+	fullBox
+	references []boxIREFReference
+}
+
+func (b *boxIREF) Size() uint32 {
+	size := b.fullBox.Size()
+	for _, r := range b.references {
+		size += r.Size()
+	}
+	return size
+}
+
+func (b *boxIREF) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeIREF
+	if _, err = b.fullBox.WriteTo(w); err != nil {
+		return
+	}
+	for _, r := range b.references {
+		if _, err = r.WriteTo(w); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Single Item Type Reference Box, type of the box is the reference type
+type boxIREFReference struct {
+	box
+	fromItemID     uint16
+	referenceCount uint16
+	toItemIDs      []uint16
+}
+
+func (r *boxIREFReference) Size() uint32 {
+	return r.box.Size() + 2 /*from_item_ID*/ + 2 /*reference_count*/ +
+		uint32(len(r.toItemIDs))*2
+}
+
+func (r *boxIREFReference) WriteTo(w io.Writer) (n int64, err error) {
+	r.size = r.Size()
+	r.referenceCount = uint16(len(r.toItemIDs))
+	if _, err = r.box.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, r.fromItemID, r.referenceCount, r.toItemIDs)
+	return
+}
+
+//----------------------------------------------------------------------
+
 // Item Properties Box
 type boxIPRP struct {
 	box
 	propertyContainer boxIPCO
 	association       boxIPMA
+	other             []anyBox
 }
 
 func (b *boxIPRP) Size() uint32 {
-	return b.box.Size() + b.propertyContainer.Size() + b.association.Size()
+	size := b.box.Size() + b.propertyContainer.Size() + b.association.Size()
+	for _, o := range b.other {
+		size += o.Size()
+	}
+	return size
 }
 
 func (b *boxIPRP) WriteTo(w io.Writer) (n int64, err error) {
@@ -426,7 +585,14 @@ func (b *boxIPRP) WriteTo(w io.Writer) (n int64, err error) {
 	if _, err = b.box.WriteTo(w); err != nil {
 		return
 	}
-	err = writeAll(w, &b.propertyContainer, &b.association)
+	if err = writeAll(w, &b.propertyContainer, &b.association); err != nil {
+		return
+	}
+	for _, o := range b.other {
+		if _, err = o.WriteTo(w); err != nil {
+			return
+		}
+	}
 	return
 }
 
@@ -460,10 +626,7 @@ func (b *boxIPCO) WriteTo(w io.Writer) (n int64, err error) {
 	return
 }
 
-type boxIPCOProperty interface {
-	io.WriterTo
-	Size() uint32
-}
+type boxIPCOProperty anyBox
 
 //----------------------------------------------------------------------
 
@@ -624,6 +787,200 @@ func (b *boxPIXI) WriteTo(w io.Writer) (n int64, err error) {
 
 //----------------------------------------------------------------------
 
+// Auxiliary type property
+type boxAUXC struct {
+	fullBox
+	auxType    string
+	auxSubtype []byte
+}
+
+func (b *boxAUXC) Size() uint32 {
+	return b.fullBox.Size() + ulen(b.auxType) + 1 /*\0*/ + uint32(len(b.auxSubtype))
+}
+
+func (b *boxAUXC) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeAUXC
+	if _, err = b.fullBox.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, []byte(b.auxType), []byte{0}, b.auxSubtype)
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Colour information
+type boxCOLR struct {
+	box
+	colourType fourCC
+	//--- nclx
+	colourPrimaries         uint16
+	transferCharacteristics uint16
+	matrixCoefficients      uint16
+	fullRangeFlag           bool
+	reserved                uint8 // 7 bits
+	//--- other types
+	iccProfile []byte
+}
+
+func (b *boxCOLR) Size() uint32 {
+	size := b.box.Size() + 4 /*colour_type*/
+	if b.colourType == colourTypeNCLX {
+		// colour_primaries + transfer_characteristics + matrix_coefficients +
+		// full_range_flag + reserved
+		size += 2 + 2 + 2 + 1
+	} else {
+		size += uint32(len(b.iccProfile))
+	}
+	return size
+}
+
+func (b *boxCOLR) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeCOLR
+	if _, err = b.box.WriteTo(w); err != nil {
+		return
+	}
+	if err = writeBE(w, b.colourType); err != nil {
+		return
+	}
+	if b.colourType == colourTypeNCLX {
+		b.reserved = 0
+		fullRangeFlagAndReserved := bflag(b.fullRangeFlag, 8) | (b.reserved & 0x7f)
+		err = writeBE(w, b.colourPrimaries, b.transferCharacteristics,
+			b.matrixCoefficients, fullRangeFlagAndReserved)
+	} else {
+		_, err = w.Write(b.iccProfile)
+	}
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Clean aperture
+type boxCLAP struct {
+	box
+	cleanApertureWidthN  uint32
+	cleanApertureWidthD  uint32
+	cleanApertureHeightN uint32
+	cleanApertureHeightD uint32
+	horizOffN            int32
+	horizOffD            uint32
+	vertOffN             int32
+	vertOffD             uint32
+}
+
+// Return clean aperture box describing the rectangle within the image
+// of the given size.
+func newCLAP(width, height int, r image.Rectangle) *boxCLAP {
+	// Offsets are of the aperture center relative to the image center.
+	return &boxCLAP{
+		cleanApertureWidthN:  uint32(r.Dx()),
+		cleanApertureWidthD:  1,
+		cleanApertureHeightN: uint32(r.Dy()),
+		cleanApertureHeightD: 1,
+		horizOffN:            int32(2*r.Min.X + r.Dx() - width),
+		horizOffD:            2,
+		vertOffN:             int32(2*r.Min.Y + r.Dy() - height),
+		vertOffD:             2,
+	}
+}
+
+// Return rectangle within the image of the given size described by the
+// box. Only integer apertures are supported.
+func (b *boxCLAP) rect(width, height int) (image.Rectangle, bool) {
+	div := func(n, d int64) (int, bool) {
+		if d <= 0 || n%d != 0 {
+			return 0, false
+		}
+		return int(n / d), true
+	}
+	w, ok1 := div(int64(b.cleanApertureWidthN), int64(b.cleanApertureWidthD))
+	h, ok2 := div(int64(b.cleanApertureHeightN), int64(b.cleanApertureHeightD))
+	// left = horizOff + (width - w) / 2
+	x, ok3 := div(2*int64(b.horizOffN)+int64(b.horizOffD)*int64(width-w), 2*int64(b.horizOffD))
+	y, ok4 := div(2*int64(b.vertOffN)+int64(b.vertOffD)*int64(height-h), 2*int64(b.vertOffD))
+	r := image.Rect(x, y, x+w, y+h)
+	if !ok1 || !ok2 || !ok3 || !ok4 || w <= 0 || h <= 0 || !r.In(image.Rect(0, 0, width, height)) {
+		return image.Rectangle{}, false
+	}
+	return r, true
+}
+
+// Check whether the rectangle is the valid clean aperture of the image
+// of the given size. Aperture must start at chroma sample.
+func validCleanAperture(r image.Rectangle, width, height int, sx, sy bool) bool {
+	if r.Empty() || !r.In(image.Rect(0, 0, width, height)) {
+		return false
+	}
+	return (!sx || r.Min.X%2 == 0) && (!sy || r.Min.Y%2 == 0)
+}
+
+func (b *boxCLAP) Size() uint32 {
+	return b.box.Size() + 8*4
+}
+
+func (b *boxCLAP) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeCLAP
+	if _, err = b.box.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, b.cleanApertureWidthN, b.cleanApertureWidthD,
+		b.cleanApertureHeightN, b.cleanApertureHeightD,
+		b.horizOffN, b.horizOffD, b.vertOffN, b.vertOffD)
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Image rotation
+type boxIROT struct {
+	box
+	reserved uint8
+	angle    uint8 // anti-clockwise, in 90 degree units
+}
+
+func (b *boxIROT) Size() uint32 {
+	return b.box.Size() + 1 /*reserved + angle*/
+}
+
+func (b *boxIROT) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeIROT
+	if _, err = b.box.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, b.reserved<<2|b.angle&0x03)
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Image mirroring
+type boxIMIR struct {
+	box
+	reserved uint8
+	axis     uint8 // 0 for vertical axis, 1 for horizontal one
+}
+
+func (b *boxIMIR) Size() uint32 {
+	return b.box.Size() + 1 /*reserved + axis*/
+}
+
+func (b *boxIMIR) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeIMIR
+	if _, err = b.box.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, b.reserved<<1|b.axis&0x01)
+	return
+}
+
+//----------------------------------------------------------------------
+
 // Item Property Association
 type boxIPMA struct {
 	fullBox
@@ -716,84 +1073,590 @@ func getSubsamplingXY(subsampling image.YCbCrSubsampleRatio) (x bool, y bool) {
 	return
 }
 
-func muxFrame(w io.Writer, m image.Image, subsampling image.YCbCrSubsampleRatio, obuData []byte) (err error) {
-	// TODO(Kagami): Parse params from Sequence Header OBU instead?
-	rec := m.Bounds()
-	width := uint32(rec.Max.X - rec.Min.X)
-	height := uint32(rec.Max.Y - rec.Min.Y)
-	sx, sy := getSubsamplingXY(subsampling)
+func getSeqProfile(subsampling image.YCbCrSubsampleRatio, depth int) uint8 {
+	if depth == 12 {
+		return 2
+	}
+	switch subsampling {
+	case image.YCbCrSubsampleRatio444:
+		return 1
+	case image.YCbCrSubsampleRatio422:
+		return 2
+	}
+	return 0
+}
+
+// A colorConfig describes colour of the image as it's signaled both in
+// AV1 sequence header and in the container.
+type colorConfig struct {
+	colorPrimaries          uint16
+	transferCharacteristics uint16
+	matrixCoefficients      uint16
+	fullRange               bool
+	iccProfile              []byte // container only
+}
+
+// An av1Image is the coded AV1 image along with parameters needed to
+// describe it in the container.
+type av1Image struct {
+	width       uint32
+	height      uint32
+	subsampling image.YCbCrSubsampleRatio
+	depth       int
+	monochrome  bool
+	chromaPos   uint8           // chroma sample position of 4:2:0 image
+	color       *colorConfig    // optional
+	clap        image.Rectangle // clean aperture, empty if not set
+	rotation    uint8           // anti-clockwise, in 90 degree units
+	mirror      Mirror          // applied after rotation
+	obuData     []byte
+	// Tiles of the grid in row-major order, obuData is not used if set.
+	tiles   []*av1Image
+	columns int
+}
+
+// Return codec configuration of the image derived from sequence header of
+// its coded data. Parameters of the image signaled in the container must
+// agree with the bitstream.
+func (img *av1Image) config() (c boxAV1CConfig, err error) {
+	h, err := findSequenceHeader(img.obuData)
+	if err != nil {
+		return
+	}
+	sx, sy := getSubsamplingXY(img.subsampling)
+	if img.monochrome {
+		sx, sy = true, true
+	}
+	switch {
+	case h.bitDepth != img.depth:
+		err = MuxerError("bit depth contradicts sequence header")
+	case h.monochrome != img.monochrome:
+		err = MuxerError("monochrome flag contradicts sequence header")
+	case h.subsamplingX != sx || h.subsamplingY != sy:
+		err = MuxerError("subsampling contradicts sequence header")
+	case !img.monochrome && sx && sy && h.chromaSamplePosition != img.chromaPos:
+		err = MuxerError("chroma sample position contradicts sequence header")
+	case h.maxFrameWidth < img.width || h.maxFrameHeight < img.height:
+		err = MuxerError("image size exceeds sequence header")
+	}
+	if color := img.color; color != nil && err == nil {
+		if h.fullRange != color.fullRange {
+			err = MuxerError("colour range contradicts sequence header")
+		} else if h.colorDescriptionPresent &&
+			(h.colorPrimaries != color.colorPrimaries ||
+				h.transferCharacteristics != color.transferCharacteristics ||
+				h.matrixCoefficients != color.matrixCoefficients) {
+			err = MuxerError("colour description contradicts sequence header")
+		}
+	}
+	if err != nil {
+		return
+	}
+	c = boxAV1CConfig{
+		seqProfile:           h.profile,
+		seqLevelIdx0:         h.levelIdx0,
+		seqTier0:             h.tier0,
+		highBitdepth:         h.bitDepth > 8,
+		twelveBit:            h.bitDepth == 12,
+		monochrome:           h.monochrome,
+		chromaSubsamplingX:   h.subsamplingX,
+		chromaSubsamplingY:   h.subsamplingY,
+		chromaSamplePosition: h.chromaSamplePosition,
+		configOBUs:           h.unit,
+	}
+	return
+}
 
-	fileData := boxMDAT{data: obuData}
-	fileType := boxFTYP{
-		majorBrand:       itemTypeAVIF,
-		compatibleBrands: []fourCC{itemTypeMIF1, itemTypeAVIF, itemTypeMIAF},
+func (img *av1Image) pixi() *boxPIXI {
+	bpc := uint8(img.depth)
+	if img.monochrome {
+		return &boxPIXI{bitsPerChannel: []uint8{bpc}}
 	}
-	metadata := boxMETA{
-		theHandler: boxHDLR{
-			handlerType: itemTypePICT,
-			name:        "go-avif v0",
-		},
-		primaryResource: boxPITM{itemID: 1},
-		itemLocations: boxILOC{
-			// NOTE(Kagami): We predefine location item even while we don't
-			// know corrent offsets yet in order to fix them in place later.
-			// It's needed because meta box goes before mdat box therefore
-			// size of the metadata can't change. We only use baseOffset and
-			// extentLength so occupy 32-bit storage space for them. They're
-			// unlikely to overflow (>4GB image is not practical).
-			lengthSize:     4,
-			baseOffsetSize: 4,
-			items: []boxILOCItem{
-				boxILOCItem{
-					itemID:  1,
-					extents: []boxILOCItemExtent{{}},
-				},
-			},
-		},
-		itemInfos: boxIINF{
-			itemInfos: []boxINFEv2{
-				boxINFEv2{
-					itemID:   1,
-					itemType: itemTypeAV01,
-					itemName: "Image",
-				},
-			},
+	return &boxPIXI{bitsPerChannel: []uint8{bpc, bpc, bpc}}
+}
+
+// Return data of the grid image item.
+func (img *av1Image) gridData() []byte {
+	rows := len(img.tiles) / img.columns
+	data := []byte{0 /*version*/, 0 /*flags*/, uint8(rows - 1), uint8(img.columns - 1)}
+	if img.width > math.MaxUint16 || img.height > math.MaxUint16 {
+		// 32-bit output dimensions.
+		data[1] = 1
+		data = append(data, make([]byte, 8)...)
+		binary.BigEndian.PutUint32(data[4:], img.width)
+		binary.BigEndian.PutUint32(data[8:], img.height)
+	} else {
+		data = append(data, make([]byte, 4)...)
+		binary.BigEndian.PutUint16(data[4:], uint16(img.width))
+		binary.BigEndian.PutUint16(data[6:], uint16(img.height))
+	}
+	return data
+}
+
+// A muxer collects items along with their properties and writes them
+// out as a single file.
+type muxer struct {
+	fileType boxFTYP
+	metadata boxMETA
+	itemData [][]byte
+	// Tracks of the image sequence, optional.
+	tracks    []*av1Track
+	timescale uint32
+	loopCount int
+}
+
+func newMuxer() *muxer {
+	return &muxer{
+		fileType: boxFTYP{
+			majorBrand:       itemTypeAVIF,
+			compatibleBrands: []fourCC{itemTypeMIF1, itemTypeAVIF, itemTypeMIAF},
 		},
-		itemProps: boxIPRP{
-			propertyContainer: boxIPCO{
-				properties: []boxIPCOProperty{
-					&boxISPE{imageWidth: width, imageHeight: height},
-					&boxPASP{hSpacing: 1, vSpacing: 1},
-					&boxAV1C{
-						// Only 8-bit at the moment.
-						av1Config: boxAV1CConfig{
-							chromaSubsamplingX: sx,
-							chromaSubsamplingY: sy,
-						},
-					},
-					&boxPIXI{bitsPerChannel: []uint8{8, 8, 8}},
-				},
+		metadata: boxMETA{
+			theHandler: boxHDLR{
+				handlerType: itemTypePICT,
+				name:        "go-avif v0",
 			},
-			association: boxIPMA{
-				entries: []boxIPMAAssociation{
-					boxIPMAAssociation{
-						itemID: 1,
-						props: []boxIPMAAssociationProperty{
-							{false, 1}, // non-essential width/height
-							{false, 2}, // non-essential aspect ratio
-							{true, 3},  // essential AV1 config
-							{true, 4},  // essential bitdepth
-						},
-					},
-				},
+			itemLocations: boxILOC{
+				// NOTE(Kagami): We predefine location items even while we
+				// don't know corrent offsets yet in order to fix them in
+				// place later. It's needed because meta box goes before mdat
+				// box therefore size of the metadata can't change. We only
+				// use baseOffset and extentLength so occupy 32-bit storage
+				// space for them. They're unlikely to overflow (>4GB image
+				// is not practical).
+				lengthSize:     4,
+				baseOffsetSize: 4,
 			},
 		},
 	}
+}
+
+// addItem adds item with the given info and data stored in mdat.
+// Returns ID of the new item.
+func (m *muxer) addItem(info boxINFEv2, data []byte) uint16 {
+	id := uint16(len(m.itemData) + 1)
+	info.itemID = id
+	m.itemData = append(m.itemData, data)
+	m.metadata.itemLocations.items = append(m.metadata.itemLocations.items, boxILOCItem{
+		itemID:  id,
+		extents: []boxILOCItemExtent{{extentLength: uint64(len(data))}},
+	})
+	m.metadata.itemInfos.itemInfos = append(m.metadata.itemInfos.itemInfos, info)
+	return id
+}
+
+// addProperty adds property to the container. Returns index of the new
+// property.
+func (m *muxer) addProperty(p boxIPCOProperty) uint16 {
+	c := &m.metadata.itemProps.propertyContainer
+	c.properties = append(c.properties, p)
+	return uint16(len(c.properties))
+}
+
+// addItemProperty adds property and associates it with the item.
+func (m *muxer) addItemProperty(itemID uint16, essential bool, p boxIPCOProperty) {
+	m.associate(itemID, essential, m.addProperty(p))
+}
+
+func (m *muxer) associate(itemID uint16, essential bool, propertyIndex uint16) {
+	a := &m.metadata.itemProps.association
+	if propertyIndex > 0x7f {
+		// Switch to 15-bit property indexes.
+		a.flags |= 1
+	}
+	prop := boxIPMAAssociationProperty{essential, propertyIndex}
+	for i := range a.entries {
+		if a.entries[i].itemID == itemID {
+			a.entries[i].props = append(a.entries[i].props, prop)
+			return
+		}
+	}
+	// Items are added in order so entries stay sorted by ID as required.
+	a.entries = append(a.entries, boxIPMAAssociation{
+		itemID: itemID,
+		props:  []boxIPMAAssociationProperty{prop},
+	})
+}
+
+// addReference adds reference of the given type from one item to
+// others.
+func (m *muxer) addReference(typ fourCC, fromItemID uint16, toItemIDs ...uint16) {
+	if m.metadata.itemRefs == nil {
+		m.metadata.itemRefs = &boxIREF{}
+	}
+	m.metadata.itemRefs.references = append(m.metadata.itemRefs.references, boxIREFReference{
+		box:        box{typ: typ},
+		fromItemID: fromItemID,
+		toItemIDs:  toItemIDs,
+	})
+}
+
+// addCodingProperties adds properties of the coded AV1 image and
+// associates them with the given items.
+func (m *muxer) addCodingProperties(img *av1Image, itemIDs ...uint16) error {
+	config, err := img.config()
+	if err != nil {
+		return err
+	}
+	props := []struct {
+		essential bool
+		prop      boxIPCOProperty
+	}{
+		{false, &boxISPE{imageWidth: img.width, imageHeight: img.height}},
+		{false, &boxPASP{hSpacing: 1, vSpacing: 1}},
+		{true, &boxAV1C{av1Config: config}},
+		{true, img.pixi()},
+	}
+	for _, p := range props {
+		index := m.addProperty(p.prop)
+		for _, id := range itemIDs {
+			m.associate(id, p.essential, index)
+		}
+	}
+	return nil
+}
+
+// addImage adds AV1 image item with its properties, either coded image
+// or grid of tiles. Returns ID of the new item.
+func (m *muxer) addImage(name string, img *av1Image) (uint16, error) {
+	var id uint16
+	if img.tiles == nil {
+		id = m.addItem(boxINFEv2{itemType: itemTypeAV01, itemName: name}, img.obuData)
+		if err := m.addCodingProperties(img, id); err != nil {
+			return 0, err
+		}
+	} else {
+		// Tiles are only displayed as part of the grid.
+		tileIDs := make([]uint16, len(img.tiles))
+		for i, tile := range img.tiles {
+			info := boxINFEv2{itemType: itemTypeAV01}
+			info.flags = 1 // hidden
+			tileIDs[i] = m.addItem(info, tile.obuData)
+			if i > 0 {
+				// Only validate the rest, they must be coded the same way.
+				if _, err := tile.config(); err != nil {
+					return 0, err
+				}
+			}
+		}
+		// Tiles are coded the same way so share the properties.
+		if err := m.addCodingProperties(img.tiles[0], tileIDs...); err != nil {
+			return 0, err
+		}
+		id = m.addItem(boxINFEv2{itemType: itemTypeGRID, itemName: name}, img.gridData())
+		m.addReference(refTypeDIMG, id, tileIDs...)
+		m.addItemProperty(id, false, &boxISPE{imageWidth: img.width, imageHeight: img.height})
+		m.addItemProperty(id, false, &boxPASP{hSpacing: 1, vSpacing: 1})
+		m.addItemProperty(id, true, img.pixi())
+	}
+	if c := img.color; c != nil {
+		if len(c.iccProfile) != 0 {
+			m.addItemProperty(id, false, &boxCOLR{
+				colourType: colourTypePROF,
+				iccProfile: c.iccProfile,
+			})
+		}
+		m.addItemProperty(id, false, &boxCOLR{
+			colourType:              colourTypeNCLX,
+			colourPrimaries:         c.colorPrimaries,
+			transferCharacteristics: c.transferCharacteristics,
+			matrixCoefficients:      c.matrixCoefficients,
+			fullRangeFlag:           c.fullRange,
+		})
+	}
+	// Transformative properties must be essential and go in the order of
+	// application.
+	if !img.clap.Empty() {
+		m.addItemProperty(id, true, newCLAP(int(img.width), int(img.height), img.clap))
+	}
+	if img.rotation != 0 {
+		m.addItemProperty(id, true, &boxIROT{angle: img.rotation})
+	}
+	if img.mirror != MirrorNone {
+		m.addItemProperty(id, true, &boxIMIR{axis: uint8(img.mirror - MirrorVertical)})
+	}
+	return id, nil
+}
+
+func (m *muxer) WriteTo(w io.Writer) (n int64, err error) {
+	chunks := append([][]byte{}, m.itemData...)
+	var movie *boxContainer
+	if len(m.tracks) != 0 {
+		if movie, err = m.movie(); err != nil {
+			return
+		}
+		for _, t := range m.tracks {
+			if t.itemID != 0 {
+				// The first sample is stored as the item.
+				chunks = append(chunks, t.samples[1:]...)
+			} else {
+				chunks = append(chunks, t.samples...)
+			}
+		}
+	}
+	fileData := boxMDAT{data: bytes.Join(chunks, nil)}
 	// Can fix iloc offsets now.
-	locItem := &metadata.itemLocations.items[0]
-	locItem.baseOffset = uint64(fileType.Size() + metadata.Size() + fileData.box.Size())
-	locItem.extents[0].extentLength = uint64(len(fileData.data))
+	offset := uint64(m.fileType.Size() + m.metadata.Size() + fileData.box.Size())
+	if movie != nil {
+		offset += uint64(movie.Size())
+	}
+	for i := range m.metadata.itemLocations.items {
+		locItem := &m.metadata.itemLocations.items[i]
+		locItem.baseOffset = offset
+		offset += locItem.extents[0].extentLength
+	}
+	// And chunk offsets of tracks, samples follow items.
+	for _, t := range m.tracks {
+		for i, s := range t.samples {
+			if i == 0 && t.itemID != 0 {
+				t.chunkOffsets.chunkOffsets[i] = uint32(m.metadata.itemLocations.items[t.itemID-1].baseOffset)
+				continue
+			}
+			t.chunkOffsets.chunkOffsets[i] = uint32(offset)
+			offset += uint64(len(s))
+		}
+	}
+	if offset > math.MaxUint32 {
+		return 0, MuxerError("file is too large")
+	}
+	if err = writeAll(w, &m.fileType, &m.metadata); err != nil {
+		return
+	}
+	if movie != nil {
+		if _, err = movie.WriteTo(w); err != nil {
+			return
+		}
+	}
+	_, err = fileData.WriteTo(w)
+	return
+}
 
-	err = writeAll(w, &fileType, &metadata, &fileData)
+// An imageMetadata is the metadata attached to the image.
+type imageMetadata struct {
+	exif []byte
+	xmp  []byte
+}
+
+// addMetadata adds metadata items describing the given image.
+func (m *muxer) addMetadata(imageID uint16, meta *imageMetadata) {
+	if len(meta.exif) != 0 {
+		// Payload is prefixed by offset to TIFF header.
+		var offset uint32
+		if bytes.HasPrefix(meta.exif, exifHeader) {
+			offset = uint32(len(exifHeader))
+		}
+		data := make([]byte, 4, 4+len(meta.exif))
+		binary.BigEndian.PutUint32(data, offset)
+		data = append(data, meta.exif...)
+		id := m.addItem(boxINFEv2{itemType: itemTypeEXIF, itemName: "Exif"}, data)
+		m.addReference(refTypeCDSC, id, imageID)
+	}
+	if len(meta.xmp) != 0 {
+		id := m.addItem(boxINFEv2{
+			itemType:    itemTypeMIME,
+			itemName:    "XMP",
+			contentType: contentTypeXMP,
+		}, meta.xmp)
+		m.addReference(refTypeCDSC, id, imageID)
+	}
+}
+
+func muxFrame(w io.Writer, color *av1Image, alpha *av1Image, meta *imageMetadata) (err error) {
+	m := newMuxer()
+	colorID, err := m.addImage("Image", color)
+	if err != nil {
+		return
+	}
+	m.metadata.primaryResource.itemID = colorID
+	if alpha != nil {
+		alphaID, err := m.addImage("Alpha", alpha)
+		if err != nil {
+			return err
+		}
+		m.addItemProperty(alphaID, true, &boxAUXC{auxType: auxTypeAlpha})
+		m.addReference(refTypeAUXL, alphaID, colorID)
+	}
+	if meta != nil {
+		m.addMetadata(colorID, meta)
+	}
+	_, err = m.WriteTo(w)
 	return
 }
+
+// Replace clean aperture of the item, remove it if clap is nil.
+func (b *boxMETA) setCleanAperture(itemID uint16, clap *boxCLAP) error {
+	a := &b.itemProps.association
+	var props *[]boxIPMAAssociationProperty
+	for i := range a.entries {
+		if a.entries[i].itemID == itemID {
+			props = &a.entries[i].props
+		}
+	}
+	if props == nil {
+		return DemuxerError("missing item properties")
+	}
+	c := &b.itemProps.propertyContainer
+	// Clean aperture goes first among transformative properties.
+	pos := len(*props)
+	old := -1
+	for i, p := range *props {
+		if p.propertyIndex == 0 || int(p.propertyIndex) > len(c.properties) {
+			continue
+		}
+		switch c.properties[p.propertyIndex-1].Type() {
+		case boxTypeCLAP:
+			old = i
+		case boxTypeIROT, boxTypeIMIR:
+			if i < pos {
+				pos = i
+			}
+		}
+	}
+	if clap == nil {
+		if old >= 0 {
+			*props = append((*props)[:old], (*props)[old+1:]...)
+		}
+		return nil
+	}
+	if old >= 0 {
+		index := (*props)[old].propertyIndex
+		shared := false
+		for _, e := range a.entries {
+			for _, p := range e.props {
+				shared = shared || p.propertyIndex == index && e.itemID != itemID
+			}
+		}
+		if !shared {
+			c.properties[index-1] = clap
+			(*props)[old].essential = true
+			return nil
+		}
+		*props = append((*props)[:old], (*props)[old+1:]...)
+		if old < pos {
+			pos--
+		}
+	}
+	c.properties = append(c.properties, clap)
+	index := uint16(len(c.properties))
+	if index > 0x7f {
+		// Switch to 15-bit property indexes.
+		a.flags |= 1
+	}
+	*props = append(*props, boxIPMAAssociationProperty{})
+	copy((*props)[pos+1:], (*props)[pos:])
+	(*props)[pos] = boxIPMAAssociationProperty{essential: true, propertyIndex: index}
+	return nil
+}
+
+// Check whether the value fits into the field of 0, 32 or 64 bits.
+func fitsSize(v uint64, size uint8) bool {
+	switch size {
+	case 0:
+		return v == 0
+	case 4:
+		return v <= math.MaxUint32
+	}
+	return true
+}
+
+// Shift file offsets of item data located at or after the given
+// position.
+func (b *boxILOC) shift(from uint64, delta int64) error {
+	for i := range b.items {
+		item := &b.items[i]
+		if item.constructionMethod != 0 || item.dataReferenceIndex != 0 {
+			continue
+		}
+		if item.baseOffset >= from {
+			item.baseOffset = uint64(int64(item.baseOffset) + delta)
+			if !fitsSize(item.baseOffset, b.baseOffsetSize) {
+				return MuxerError("item offset overflow")
+			}
+			continue
+		}
+		for j := range item.extents {
+			e := &item.extents[j]
+			if item.baseOffset+e.extentOffset >= from {
+				e.extentOffset = uint64(int64(e.extentOffset) + delta)
+				if !fitsSize(e.extentOffset, b.offsetSize) {
+					return MuxerError("item offset overflow")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// SetCleanAperture changes clean aperture of the primary image of AVIF
+// file read from r and writes the result to w. Rectangle is relative to
+// the top-left corner of the coded image, empty rectangle removes clean
+// aperture. Coded image data is copied as is. Image sequences are not
+// supported since their tracks carry clean aperture too.
+func SetCleanAperture(w io.Writer, r io.Reader, clap image.Rectangle) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f, err := demux(data)
+	if err != nil {
+		return err
+	}
+	id := f.primaryID()
+	var clapBox *boxCLAP
+	if !clap.Empty() {
+		ispe, _ := f.itemProperty(id, boxTypeISPE).(*boxISPE)
+		if ispe == nil {
+			return DemuxerError("missing image properties")
+		}
+		var sx, sy bool
+		if av1C := f.av1Config(id); av1C != nil && !av1C.av1Config.monochrome {
+			sx, sy = av1C.av1Config.chromaSubsamplingX, av1C.av1Config.chromaSubsamplingY
+		}
+		width, height := int(ispe.imageWidth), int(ispe.imageHeight)
+		if !validCleanAperture(clap, width, height, sx, sy) {
+			return OptionsError("bad clean aperture")
+		}
+		clapBox = newCLAP(width, height, clap)
+	}
+
+	// Locate meta box to replace it in place.
+	var metaStart, metaEnd, pos int
+	err = readBoxes(data, func(typ fourCC, payload []byte) error {
+		hdrSize := 8
+		if binary.BigEndian.Uint32(data[pos:]) == 1 {
+			hdrSize = 16
+		}
+		end := pos + hdrSize + len(payload)
+		if typ == boxTypeMETA && metaEnd == 0 {
+			metaStart, metaEnd = pos, end
+		}
+		if typ == boxTypeMOOV {
+			return DemuxerError("clean aperture of image sequences can't be changed")
+		}
+		pos = end
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if metaEnd == 0 {
+		return DemuxerError("missing meta box")
+	}
+	if err := f.metadata.setCleanAperture(id, clapBox); err != nil {
+		return err
+	}
+	// Data following meta box is moved by change of its size.
+	delta := int64(f.metadata.Size()) - int64(metaEnd-metaStart)
+	if err := f.metadata.itemLocations.shift(uint64(metaEnd), delta); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data[:metaStart]); err != nil {
+		return err
+	}
+	if _, err := f.metadata.WriteTo(w); err != nil {
+		return err
+	}
+	_, err = w.Write(data[metaEnd:])
+	return err
+}
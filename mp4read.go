@@ -0,0 +1,573 @@
+package avif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// A byteReader reads big-endian fields from the box payload. Reading
+// past the end yields zero values and sets the error.
+type byteReader struct {
+	buf []byte
+	err error
+}
+
+var zeroBytes [8]byte
+
+func (r *byteReader) next(n int) []byte {
+	if r.err != nil || n > len(r.buf) {
+		r.err = DemuxerError("truncated box")
+		r.buf = nil
+		if n <= len(zeroBytes) {
+			return zeroBytes[:n]
+		}
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *byteReader) u8() uint8 {
+	return r.next(1)[0]
+}
+
+func (r *byteReader) u16() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+func (r *byteReader) u32() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+func (r *byteReader) u64() uint64 {
+	return binary.BigEndian.Uint64(r.next(8))
+}
+
+// Read field of 0, 4 or 8 bytes.
+func (r *byteReader) uN(size uint8) uint64 {
+	switch size {
+	case 0:
+		return 0
+	case 4:
+		return uint64(r.u32())
+	case 8:
+		return r.u64()
+	}
+	r.fail("bad field size")
+	return 0
+}
+
+// Read item ID of 16 or 32 bits. We only store 16-bit IDs.
+func (r *byteReader) itemID(wide bool) uint16 {
+	if !wide {
+		return r.u16()
+	}
+	id := r.u32()
+	if id > math.MaxUint16 {
+		r.fail("unsupported item ID")
+	}
+	return uint16(id)
+}
+
+func (r *byteReader) fourCC() (c fourCC) {
+	copy(c[:], r.next(4))
+	return
+}
+
+func (r *byteReader) cstring() string {
+	i := bytes.IndexByte(r.buf, 0)
+	if i < 0 {
+		// Be tolerant to unterminated strings at the end of box.
+		return string(r.next(len(r.buf)))
+	}
+	s := string(r.next(i))
+	r.next(1)
+	return s
+}
+
+func (r *byteReader) rest() []byte {
+	return r.next(len(r.buf))
+}
+
+func (r *byteReader) fullBox(b *fullBox) {
+	versionAndFlags := r.u32()
+	b.version = uint8(versionAndFlags >> 24)
+	b.flags = versionAndFlags & 0xffffff
+}
+
+func (r *byteReader) fail(msg string) {
+	if r.err == nil {
+		r.err = DemuxerError(msg)
+	}
+}
+
+//----------------------------------------------------------------------
+
+// Iterate over boxes stored in data.
+func readBoxes(data []byte, fn func(typ fourCC, payload []byte) error) error {
+	for len(data) > 0 {
+		r := byteReader{buf: data}
+		size := uint64(r.u32())
+		typ := r.fourCC()
+		hdrSize := uint64(8)
+		if size == 1 {
+			size = r.u64()
+			hdrSize = 16
+		} else if size == 0 {
+			size = uint64(len(data))
+		}
+		if r.err != nil || size < hdrSize || size > uint64(len(data)) {
+			return DemuxerError("bad box size")
+		}
+		if size > math.MaxUint32 {
+			return DemuxerError("boxes larger than 4GB are not supported")
+		}
+		if err := fn(typ, data[hdrSize:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// Parse all boxes stored in data. Boxes of unknown type are preserved as
+// opaque payloads. Parsed boxes refer to the data so it must not be
+// modified.
+func parseBoxes(data []byte) (boxes []anyBox, err error) {
+	err = readBoxes(data, func(typ fourCC, payload []byte) error {
+		b, err := parseBox(typ, payload)
+		if err != nil {
+			return err
+		}
+		boxes = append(boxes, b)
+		return nil
+	})
+	return
+}
+
+func parseBox(typ fourCC, payload []byte) (anyBox, error) {
+	r := &byteReader{buf: payload}
+	var b anyBox
+	switch typ {
+	case boxTypeFTYP:
+		b = parseFTYP(r)
+	case boxTypeMDAT:
+		b = &boxMDAT{box: box{typ: typ}, data: r.rest()}
+	case boxTypeMETA:
+		b = parseMETA(r)
+	case boxTypeHDLR:
+		b = parseHDLR(r)
+	case boxTypePITM:
+		b = parsePITM(r)
+	case boxTypeILOC:
+		b = parseILOC(r)
+	case boxTypeIINF:
+		b = parseIINF(r)
+	case boxTypeINFE:
+		b = parseINFE(r)
+	case boxTypeIREF:
+		b = parseIREF(r)
+	case boxTypeIPRP:
+		b = parseIPRP(r)
+	case boxTypeIPCO:
+		b = parseIPCO(r)
+	case boxTypeISPE:
+		b = parseISPE(r)
+	case boxTypePASP:
+		b = parsePASP(r)
+	case boxTypeAV1C:
+		b = parseAV1C(r)
+	case boxTypePIXI:
+		b = parsePIXI(r)
+	case boxTypeAUXC:
+		b = parseAUXC(r)
+	case boxTypeCOLR:
+		b = parseCOLR(r)
+	case boxTypeCLAP:
+		b = parseCLAP(r)
+	case boxTypeIROT:
+		b = parseIROT(r)
+	case boxTypeIMIR:
+		b = parseIMIR(r)
+	case boxTypeIPMA:
+		b = parseIPMA(r)
+	default:
+		b = &boxUnknown{box: box{typ: typ}, data: r.rest()}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return b, nil
+}
+
+// Parse child boxes stored in the rest of payload.
+func (r *byteReader) children() []anyBox {
+	if r.err != nil {
+		return nil
+	}
+	boxes, err := parseBoxes(r.rest())
+	if err != nil {
+		r.err = err
+	}
+	return boxes
+}
+
+//----------------------------------------------------------------------
+
+func parseFTYP(r *byteReader) *boxFTYP {
+	b := &boxFTYP{box: box{typ: boxTypeFTYP}}
+	b.majorBrand = r.fourCC()
+	b.minorVersion = r.u32()
+	if len(r.buf)%4 != 0 {
+		r.fail("bad ftyp size")
+	}
+	for r.err == nil && len(r.buf) > 0 {
+		b.compatibleBrands = append(b.compatibleBrands, r.fourCC())
+	}
+	return b
+}
+
+func parseMETA(r *byteReader) *boxMETA {
+	b := &boxMETA{}
+	b.typ = boxTypeMETA
+	r.fullBox(&b.fullBox)
+	for _, child := range r.children() {
+		switch c := child.(type) {
+		case *boxHDLR:
+			b.theHandler = *c
+		case *boxPITM:
+			b.primaryResource = *c
+		case *boxILOC:
+			b.itemLocations = *c
+		case *boxIINF:
+			b.itemInfos = *c
+		case *boxIREF:
+			b.itemRefs = c
+		case *boxIPRP:
+			b.itemProps = *c
+		default:
+			b.other = append(b.other, child)
+		}
+	}
+	return b
+}
+
+func parseHDLR(r *byteReader) *boxHDLR {
+	b := &boxHDLR{}
+	b.typ = boxTypeHDLR
+	r.fullBox(&b.fullBox)
+	b.preDefined = r.u32()
+	b.handlerType = r.fourCC()
+	for i := range b.reserved {
+		b.reserved[i] = r.u32()
+	}
+	b.name = r.cstring()
+	if len(r.buf) > 0 {
+		b.trailing = r.rest()
+	}
+	return b
+}
+
+func parsePITM(r *byteReader) *boxPITM {
+	b := &boxPITM{}
+	b.typ = boxTypePITM
+	r.fullBox(&b.fullBox)
+	b.itemID = r.itemID(b.version >= 1)
+	// We only write 16-bit IDs.
+	b.version = 0
+	return b
+}
+
+func parseILOC(r *byteReader) *boxILOC {
+	b := &boxILOC{}
+	b.typ = boxTypeILOC
+	r.fullBox(&b.fullBox)
+	if b.version > 2 {
+		r.fail("unsupported iloc version")
+		return b
+	}
+	offsetSizeAndLengthSize := r.u8()
+	b.offsetSize = offsetSizeAndLengthSize >> 4
+	b.lengthSize = offsetSizeAndLengthSize & 0xf
+	baseOffsetSizeAndIndexSize := r.u8()
+	b.baseOffsetSize = baseOffsetSizeAndIndexSize >> 4
+	if b.version >= 1 {
+		b.indexSize = baseOffsetSizeAndIndexSize & 0xf
+	}
+	var itemCount uint32
+	if b.version < 2 {
+		itemCount = uint32(r.u16())
+	} else {
+		itemCount = r.u32()
+	}
+	for i := uint32(0); i < itemCount && r.err == nil; i++ {
+		var item boxILOCItem
+		item.itemID = r.itemID(b.version == 2)
+		if b.version >= 1 {
+			item.constructionMethod = uint8(r.u16() & 0xf)
+		}
+		item.dataReferenceIndex = r.u16()
+		item.baseOffset = r.uN(b.baseOffsetSize)
+		item.extentCount = r.u16()
+		for j := uint16(0); j < item.extentCount && r.err == nil; j++ {
+			var e boxILOCItemExtent
+			if b.version >= 1 {
+				e.extentIndex = r.uN(b.indexSize)
+			}
+			e.extentOffset = r.uN(b.offsetSize)
+			e.extentLength = r.uN(b.lengthSize)
+			item.extents = append(item.extents, e)
+		}
+		b.items = append(b.items, item)
+	}
+	// We only write 16-bit IDs.
+	if b.version == 2 {
+		b.version = 1
+	}
+	return b
+}
+
+func parseIINF(r *byteReader) *boxIINF {
+	b := &boxIINF{}
+	b.typ = boxTypeIINF
+	r.fullBox(&b.fullBox)
+	if b.version == 0 {
+		r.u16()
+	} else {
+		r.u32()
+	}
+	// We only write 16-bit entry count.
+	b.version = 0
+	for _, child := range r.children() {
+		if ie, ok := child.(*boxINFEv2); ok {
+			b.itemInfos = append(b.itemInfos, *ie)
+		} else if child.Type() == boxTypeINFE {
+			b.other = append(b.other, child)
+		} else if r.err == nil {
+			r.fail("unexpected box in iinf")
+		}
+	}
+	return b
+}
+
+// Entries of unsupported versions are preserved as opaque boxes, so their
+// items are skipped.
+func parseINFE(r *byteReader) anyBox {
+	payload := r.buf
+	b := &boxINFEv2{}
+	b.typ = boxTypeINFE
+	r.fullBox(&b.fullBox)
+	if r.err == nil && (b.version < 2 || b.version > 3) {
+		r.rest()
+		return &boxUnknown{box: box{typ: boxTypeINFE}, data: payload}
+	}
+	b.itemID = r.itemID(b.version == 3)
+	b.itemProtectionIndex = r.u16()
+	b.itemType = r.fourCC()
+	b.itemName = r.cstring()
+	if b.itemType == itemTypeMIME {
+		b.contentType = r.cstring()
+		if len(r.buf) > 0 {
+			b.contentEncoding = r.cstring()
+		}
+	} else if b.itemType == itemTypeURI {
+		b.itemURIType = r.cstring()
+	}
+	// We only write 16-bit IDs.
+	b.version = 2
+	return b
+}
+
+func parseIREF(r *byteReader) *boxIREF {
+	b := &boxIREF{}
+	b.typ = boxTypeIREF
+	r.fullBox(&b.fullBox)
+	if r.err != nil {
+		return b
+	}
+	wide := b.version >= 1
+	// We only write 16-bit IDs.
+	b.version = 0
+	r.err = readBoxes(r.rest(), func(typ fourCC, payload []byte) error {
+		rr := &byteReader{buf: payload}
+		ref := boxIREFReference{box: box{typ: typ}}
+		ref.fromItemID = rr.itemID(wide)
+		ref.referenceCount = rr.u16()
+		for i := uint16(0); i < ref.referenceCount && rr.err == nil; i++ {
+			ref.toItemIDs = append(ref.toItemIDs, rr.itemID(wide))
+		}
+		b.references = append(b.references, ref)
+		return rr.err
+	})
+	return b
+}
+
+func parseIPRP(r *byteReader) *boxIPRP {
+	b := &boxIPRP{box: box{typ: boxTypeIPRP}}
+	gotIPMA := false
+	for _, child := range r.children() {
+		switch c := child.(type) {
+		case *boxIPCO:
+			b.propertyContainer = *c
+		case *boxIPMA:
+			if gotIPMA {
+				r.fail("multiple ipma boxes are not supported")
+			}
+			gotIPMA = true
+			b.association = *c
+		default:
+			b.other = append(b.other, child)
+		}
+	}
+	return b
+}
+
+func parseIPCO(r *byteReader) *boxIPCO {
+	b := &boxIPCO{box: box{typ: boxTypeIPCO}}
+	for _, child := range r.children() {
+		b.properties = append(b.properties, child)
+	}
+	return b
+}
+
+func parseISPE(r *byteReader) *boxISPE {
+	b := &boxISPE{}
+	b.typ = boxTypeISPE
+	r.fullBox(&b.fullBox)
+	b.imageWidth = r.u32()
+	b.imageHeight = r.u32()
+	return b
+}
+
+func parsePASP(r *byteReader) *boxPASP {
+	b := &boxPASP{box: box{typ: boxTypePASP}}
+	b.hSpacing = r.u32()
+	b.vSpacing = r.u32()
+	return b
+}
+
+func parseAV1C(r *byteReader) *boxAV1C {
+	b := &boxAV1C{box: box{typ: boxTypeAV1C}}
+	c := &b.av1Config
+	markerAndVersion := r.u8()
+	c.marker = markerAndVersion&0x80 != 0
+	c.version = markerAndVersion & 0x7f
+	if r.err == nil && (!c.marker || c.version != 1) {
+		r.fail("unsupported av1C version")
+	}
+	seqProfileAndSeqLevelIdx0 := r.u8()
+	c.seqProfile = seqProfileAndSeqLevelIdx0 >> 5
+	c.seqLevelIdx0 = seqProfileAndSeqLevelIdx0 & 0x1f
+	codecParams := r.u8()
+	c.seqTier0 = codecParams&0x80 != 0
+	c.highBitdepth = codecParams&0x40 != 0
+	c.twelveBit = codecParams&0x20 != 0
+	c.monochrome = codecParams&0x10 != 0
+	c.chromaSubsamplingX = codecParams&0x08 != 0
+	c.chromaSubsamplingY = codecParams&0x04 != 0
+	c.chromaSamplePosition = codecParams & 3
+	presentationParams := r.u8()
+	c.reserved = presentationParams >> 5
+	c.initialPresentationDelayPresent = presentationParams&0x10 != 0
+	if c.initialPresentationDelayPresent {
+		c.initialPresentationDelayMinusOne = presentationParams & 0xf
+	} else {
+		c.reserved2 = presentationParams & 0xf
+	}
+	c.configOBUs = r.rest()
+	return b
+}
+
+func parsePIXI(r *byteReader) *boxPIXI {
+	b := &boxPIXI{}
+	b.typ = boxTypePIXI
+	r.fullBox(&b.fullBox)
+	b.numChannels = r.u8()
+	b.bitsPerChannel = append([]uint8{}, r.next(int(b.numChannels))...)
+	return b
+}
+
+func parseAUXC(r *byteReader) *boxAUXC {
+	b := &boxAUXC{}
+	b.typ = boxTypeAUXC
+	r.fullBox(&b.fullBox)
+	b.auxType = r.cstring()
+	b.auxSubtype = r.rest()
+	return b
+}
+
+func parseCOLR(r *byteReader) *boxCOLR {
+	b := &boxCOLR{box: box{typ: boxTypeCOLR}}
+	b.colourType = r.fourCC()
+	if b.colourType == colourTypeNCLX {
+		b.colourPrimaries = r.u16()
+		b.transferCharacteristics = r.u16()
+		b.matrixCoefficients = r.u16()
+		fullRangeFlagAndReserved := r.u8()
+		b.fullRangeFlag = fullRangeFlagAndReserved&0x80 != 0
+		b.reserved = fullRangeFlagAndReserved & 0x7f
+	} else {
+		b.iccProfile = r.rest()
+	}
+	return b
+}
+
+func parseCLAP(r *byteReader) *boxCLAP {
+	b := &boxCLAP{box: box{typ: boxTypeCLAP}}
+	b.cleanApertureWidthN = r.u32()
+	b.cleanApertureWidthD = r.u32()
+	b.cleanApertureHeightN = r.u32()
+	b.cleanApertureHeightD = r.u32()
+	b.horizOffN = int32(r.u32())
+	b.horizOffD = r.u32()
+	b.vertOffN = int32(r.u32())
+	b.vertOffD = r.u32()
+	return b
+}
+
+func parseIROT(r *byteReader) *boxIROT {
+	b := &boxIROT{box: box{typ: boxTypeIROT}}
+	reservedAndAngle := r.u8()
+	b.reserved = reservedAndAngle >> 2
+	b.angle = reservedAndAngle & 0x03
+	return b
+}
+
+func parseIMIR(r *byteReader) *boxIMIR {
+	b := &boxIMIR{box: box{typ: boxTypeIMIR}}
+	reservedAndAxis := r.u8()
+	b.reserved = reservedAndAxis >> 1
+	b.axis = reservedAndAxis & 0x01
+	return b
+}
+
+func parseIPMA(r *byteReader) *boxIPMA {
+	b := &boxIPMA{}
+	b.typ = boxTypeIPMA
+	r.fullBox(&b.fullBox)
+	b.entryCount = r.u32()
+	for i := uint32(0); i < b.entryCount && r.err == nil; i++ {
+		var a boxIPMAAssociation
+		a.itemID = r.itemID(b.version >= 1)
+		a.associationCount = r.u8()
+		for j := uint8(0); j < a.associationCount && r.err == nil; j++ {
+			var p boxIPMAAssociationProperty
+			if b.flags&1 == 1 {
+				v := r.u16()
+				p.essential = v&0x8000 != 0
+				p.propertyIndex = v & 0x7fff
+			} else {
+				v := r.u8()
+				p.essential = v&0x80 != 0
+				p.propertyIndex = uint16(v & 0x7f)
+			}
+			a.props = append(a.props, p)
+		}
+		b.entries = append(b.entries, a)
+	}
+	// We only write 16-bit IDs.
+	b.version = 0
+	return b
+}
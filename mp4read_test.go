@@ -0,0 +1,348 @@
+package avif
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"testing"
+)
+
+func muxTestFile(t *testing.T) []byte {
+	var buf bytes.Buffer
+	color := &av1Image{
+		width:       3,
+		height:      2,
+		subsampling: image.YCbCrSubsampleRatio444,
+		depth:       10,
+		color:       &colorConfig{cpBT709, tcSRGB, mcBT709, false, []byte("icc")},
+		clap:        image.Rect(1, 0, 3, 2),
+		rotation:    1,
+		mirror:      MirrorHorizontal,
+	}
+	color.obuData = testTemporalUnit(color, false, 1, 2, 3)
+	alpha := &av1Image{
+		width:       3,
+		height:      2,
+		subsampling: image.YCbCrSubsampleRatio420,
+		depth:       10,
+		monochrome:  true,
+	}
+	alpha.obuData = testTemporalUnit(alpha, true, 4, 5)
+	meta := &imageMetadata{exif: []byte("Exif\x00\x00II*\x00"), xmp: []byte("<x:xmpmeta/>")}
+	if err := muxFrame(&buf, color, alpha, meta); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseBoxesRoundTrip(t *testing.T) {
+	data := muxTestFile(t)
+	// Unknown boxes must be preserved as is.
+	data = append(data, 0, 0, 0, 11, 'f', 'r', 'e', 'e', 1, 2, 3)
+	boxes, err := parseBoxes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	for _, b := range boxes {
+		if _, err := b.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("rewritten file differs:\n%x\n%x", buf.Bytes(), data)
+	}
+}
+
+func TestParseBoxesTruncated(t *testing.T) {
+	data := muxTestFile(t)
+	for i := 1; i < len(data); i++ {
+		f, err := demux(data[:i])
+		if err == nil {
+			// Metadata items are the last ones in mdat.
+			_, err = f.itemData(uint16(len(f.metadata.itemInfos.itemInfos)))
+		}
+		if err == nil {
+			t.Errorf("no error for file truncated to %d bytes", i)
+		}
+	}
+}
+
+func TestSetCleanAperture(t *testing.T) {
+	data := muxTestFile(t)
+	src, err := demux(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, clap := range []image.Rectangle{image.Rect(0, 1, 2, 2), {}} {
+		var buf bytes.Buffer
+		if err := SetCleanAperture(&buf, bytes.NewReader(data), clap); err != nil {
+			t.Fatal(err)
+		}
+		f, err := demux(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range src.metadata.itemInfos.itemInfos {
+			want, _ := src.itemData(info.itemID)
+			if got, err := f.itemData(info.itemID); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("item %d: got %v, %v; want %v", info.itemID, got, err, want)
+			}
+		}
+		// Clean aperture must precede rotation.
+		props := f.itemProps(f.primaryID())
+		first := f.property(props[len(props)-3].propertyIndex)
+		if clap.Empty() {
+			first = f.property(props[len(props)-2].propertyIndex)
+		}
+		if c, ok := first.(*boxCLAP); ok != !clap.Empty() {
+			t.Errorf("clean aperture %v: got %v", clap, first)
+		} else if ok {
+			if r, _ := c.rect(3, 2); r != clap {
+				t.Errorf("got clean aperture %v, want %v", r, clap)
+			}
+		}
+	}
+	if err := SetCleanAperture(ioutil.Discard, bytes.NewReader(data), image.Rect(0, 0, 4, 2)); err == nil {
+		t.Error("clean aperture out of bounds accepted")
+	}
+}
+
+func TestMuxGrid(t *testing.T) {
+	newGrid := func(monochrome bool) *av1Image {
+		img := &av1Image{
+			width:       100000,
+			height:      3,
+			subsampling: image.YCbCrSubsampleRatio420,
+			depth:       8,
+			monochrome:  monochrome,
+			columns:     2,
+		}
+		for i := 0; i < 4; i++ {
+			tile := *img
+			tile.width, tile.height = 50000, 2
+			tile.obuData = testTemporalUnit(&tile, false, byte(i))
+			img.tiles = append(img.tiles, &tile)
+		}
+		return img
+	}
+	var buf bytes.Buffer
+	if err := muxFrame(&buf, newGrid(false), newGrid(true), nil); err != nil {
+		t.Fatal(err)
+	}
+	f, err := demux(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint16{f.primaryID(), f.alphaID(f.primaryID())} {
+		if info := f.item(id); info == nil || info.itemType != itemTypeGRID {
+			t.Fatalf("item %d is not a grid", id)
+		}
+		data, err := f.itemData(id)
+		if err != nil || !bytes.Equal(data, []byte{0, 1, 1, 1, 0, 1, 0x86, 0xa0, 0, 0, 0, 3}) {
+			t.Errorf("grid %d: got %v, %v", id, data, err)
+		}
+		tiles := f.references(refTypeDIMG, id)
+		if len(tiles) != 4 {
+			t.Fatalf("grid %d: got tiles %v", id, tiles)
+		}
+		for i, tileID := range tiles {
+			if f.item(tileID).flags&1 == 0 {
+				t.Errorf("tile %d isn't hidden", tileID)
+			}
+			if data, _ := f.itemData(tileID); !bytes.Equal(data[len(data)-1:], []byte{byte(i)}) {
+				t.Errorf("tile %d: got data %v", tileID, data)
+			}
+		}
+		if ispe, _ := f.itemProperty(id, boxTypeISPE).(*boxISPE); ispe == nil || ispe.imageWidth != 100000 {
+			t.Errorf("grid %d: got %v", id, ispe)
+		}
+		if av1C := f.av1Config(id); av1C == nil || av1C.av1Config.monochrome != (id != f.primaryID()) {
+			t.Errorf("grid %d: got %v", id, av1C)
+		}
+	}
+}
+
+func muxTestSequence(t *testing.T) []byte {
+	newTrack := func(monochrome bool, samples ...[]byte) *av1Track {
+		img := &av1Image{
+			width:       3,
+			height:      2,
+			subsampling: image.YCbCrSubsampleRatio420,
+			depth:       8,
+			monochrome:  monochrome,
+		}
+		return &av1Track{
+			image:     img,
+			handler:   itemTypePICT,
+			samples:   samples,
+			durations: []uint32{10, 10, 20},
+			keyframes: []bool{true, false, true},
+		}
+	}
+	color := newTrack(false, nil, []byte{4}, []byte{5, 6})
+	color.image.color = &colorConfig{cpBT709, tcSRGB, mcBT709, false, nil}
+	color.samples[0] = testTemporalUnit(color.image, false, 1, 2, 3)
+	alpha := newTrack(true, nil, []byte{8, 9}, []byte{10})
+	alpha.samples[0] = testTemporalUnit(alpha.image, false, 7)
+	alpha.handler = handlerTypeAUXV
+	meta := &imageMetadata{exif: []byte("II*\x00")}
+	var buf bytes.Buffer
+	if err := muxSequence(&buf, color, alpha, meta, 100, 0); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Return samples of each track of the file located via sample tables.
+func trackSamples(t *testing.T, data []byte) [][][]byte {
+	var offsets, sizes [][]uint32
+	var walk func(b []byte) error
+	walk = func(b []byte) error {
+		return readBoxes(b, func(typ fourCC, payload []byte) error {
+			r := &byteReader{buf: payload}
+			switch typ {
+			case boxTypeMOOV, boxTypeTRAK, boxTypeMDIA, boxTypeMINF, boxTypeSTBL:
+				return walk(payload)
+			case boxTypeSTCO:
+				r.u32()
+				var o []uint32
+				for n := r.u32(); n > 0 && r.err == nil; n-- {
+					o = append(o, r.u32())
+				}
+				offsets = append(offsets, o)
+			case boxTypeSTSZ:
+				r.u32()
+				r.u32()
+				var s []uint32
+				for n := r.u32(); n > 0 && r.err == nil; n-- {
+					s = append(s, r.u32())
+				}
+				sizes = append(sizes, s)
+			}
+			return r.err
+		})
+	}
+	if err := walk(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(offsets) != len(sizes) {
+		t.Fatalf("got %d chunk offset and %d sample size tables", len(offsets), len(sizes))
+	}
+	var tracks [][][]byte
+	for i := range offsets {
+		var samples [][]byte
+		for j, o := range offsets[i] {
+			if j >= len(sizes[i]) || uint64(o)+uint64(sizes[i][j]) > uint64(len(data)) {
+				t.Fatalf("track %d: bad sample %d", i+1, j+1)
+			}
+			samples = append(samples, data[o:o+sizes[i][j]])
+		}
+		tracks = append(tracks, samples)
+	}
+	return tracks
+}
+
+func TestMuxSequence(t *testing.T) {
+	data := muxTestSequence(t)
+	f, err := demux(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	color, _ := f.itemData(f.primaryID())
+	alpha, _ := f.itemData(f.alphaID(f.primaryID()))
+	want := [][][]byte{
+		{color, {4}, {5, 6}},
+		{alpha, {8, 9}, {10}},
+	}
+	check := func(data []byte) {
+		f, err := demux(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.fileType.majorBrand != brandAVIS {
+			t.Errorf("got major brand %q", f.fileType.majorBrand)
+		}
+		// Still image shares data with the first frame.
+		colorID := f.primaryID()
+		for i, id := range []uint16{colorID, f.alphaID(colorID)} {
+			if got, err := f.itemData(id); err != nil || !bytes.Equal(got, want[i][0]) {
+				t.Errorf("item %d: got %v, %v; want %v", id, got, err, want[i][0])
+			}
+		}
+		tracks := trackSamples(t, data)
+		if len(tracks) != len(want) {
+			t.Fatalf("got %d tracks", len(tracks))
+		}
+		for i := range want {
+			for j := range want[i] {
+				if j >= len(tracks[i]) || !bytes.Equal(tracks[i][j], want[i][j]) {
+					t.Errorf("track %d: got samples %v, want %v", i+1, tracks[i], want[i])
+					break
+				}
+			}
+		}
+	}
+	check(data)
+	if cfg, format, err := image.DecodeConfig(bytes.NewReader(data)); err != nil ||
+		format != "avif" || cfg.Width != 3 {
+		t.Errorf("got %v, %q, %v", cfg, format, err)
+	}
+	// Track would disagree with the still image.
+	if err := SetCleanAperture(ioutil.Discard, bytes.NewReader(data), image.Rect(0, 0, 2, 2)); err == nil {
+		t.Error("clean aperture of sequence changed")
+	}
+}
+
+func TestParseUnknownItemBoxes(t *testing.T) {
+	boxes, err := parseBoxes(muxTestFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range boxes {
+		if meta, ok := b.(*boxMETA); ok {
+			meta.itemProps.other = append(meta.itemProps.other,
+				&boxUnknown{box: box{typ: fourCC{'t', 'e', 's', 't'}}, data: []byte{1, 2}})
+			// Entries of versions 0 and 1 have no item type.
+			for _, version := range []byte{0, 1} {
+				meta.itemInfos.other = append(meta.itemInfos.other,
+					&boxUnknown{box: box{typ: boxTypeINFE}, data: []byte{version, 0, 0, 0, 0, 9, 0, 0, 'n', 0, 't', 0, 0}})
+			}
+		}
+	}
+	var src bytes.Buffer
+	for _, b := range boxes {
+		if _, err := b.WriteTo(&src); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := demux(src.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(f.metadata.itemProps.other); n != 1 {
+		t.Errorf("got %d unknown iprp children, want 1", n)
+	}
+	if n := len(f.metadata.itemInfos.other); n != 2 {
+		t.Errorf("got %d skipped infe boxes, want 2", n)
+	}
+	if f.item(9) != nil {
+		t.Error("item of unsupported infe version is not skipped")
+	}
+	if f.item(f.primaryID()) == nil {
+		t.Error("missing primary item")
+	}
+	boxes, err = parseBoxes(src.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	for _, b := range boxes {
+		if _, err := b.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(buf.Bytes(), src.Bytes()) {
+		t.Errorf("rewritten file differs:\n%x\n%x", buf.Bytes(), src.Bytes())
+	}
+}
@@ -0,0 +1,802 @@
+package avif
+
+import (
+	"io"
+	"math"
+)
+
+var (
+	boxTypeMOOV = fourCC{'m', 'o', 'o', 'v'}
+	boxTypeMVHD = fourCC{'m', 'v', 'h', 'd'}
+	boxTypeTRAK = fourCC{'t', 'r', 'a', 'k'}
+	boxTypeTKHD = fourCC{'t', 'k', 'h', 'd'}
+	boxTypeTREF = fourCC{'t', 'r', 'e', 'f'}
+	boxTypeEDTS = fourCC{'e', 'd', 't', 's'}
+	boxTypeELST = fourCC{'e', 'l', 's', 't'}
+	boxTypeMDIA = fourCC{'m', 'd', 'i', 'a'}
+	boxTypeMDHD = fourCC{'m', 'd', 'h', 'd'}
+	boxTypeMINF = fourCC{'m', 'i', 'n', 'f'}
+	boxTypeVMHD = fourCC{'v', 'm', 'h', 'd'}
+	boxTypeDINF = fourCC{'d', 'i', 'n', 'f'}
+	boxTypeDREF = fourCC{'d', 'r', 'e', 'f'}
+	boxTypeURL  = fourCC{'u', 'r', 'l', ' '}
+	boxTypeSTBL = fourCC{'s', 't', 'b', 'l'}
+	boxTypeSTSD = fourCC{'s', 't', 's', 'd'}
+	boxTypeAV01 = fourCC{'a', 'v', '0', '1'}
+	boxTypeCCST = fourCC{'c', 'c', 's', 't'}
+	boxTypeAUXI = fourCC{'a', 'u', 'x', 'i'}
+	boxTypeSTTS = fourCC{'s', 't', 't', 's'}
+	boxTypeSTSC = fourCC{'s', 't', 's', 'c'}
+	boxTypeSTSZ = fourCC{'s', 't', 's', 'z'}
+	boxTypeSTCO = fourCC{'s', 't', 'c', 'o'}
+	boxTypeCO64 = fourCC{'c', 'o', '6', '4'}
+	boxTypeSTSS = fourCC{'s', 't', 's', 's'}
+
+	brandAVIS = fourCC{'a', 'v', 'i', 's'}
+	brandMSF1 = fourCC{'m', 's', 'f', '1'}
+	brandISO8 = fourCC{'i', 's', 'o', '8'}
+
+	handlerTypeAUXV = fourCC{'a', 'u', 'x', 'v'}
+)
+
+// Unity transformation matrix of the movie and track headers.
+var unityMatrix = [9]int32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000}
+
+// Track duration meaning that it's not known or infinite.
+const indefiniteDuration = math.MaxUint32
+
+// Packed ISO-639-2/T code of undetermined language.
+const languageUND = ('u'-0x60)<<10 | ('n'-0x60)<<5 | ('d' - 0x60)
+
+//----------------------------------------------------------------------
+
+// Box which only holds other boxes, type is set on construction
+type boxContainer struct {
+	box
+	children []anyBox
+}
+
+func newContainer(typ fourCC, children ...anyBox) *boxContainer {
+	return &boxContainer{box: box{typ: typ}, children: children}
+}
+
+func (b *boxContainer) Size() uint32 {
+	size := b.box.Size()
+	for _, c := range b.children {
+		size += c.Size()
+	}
+	return size
+}
+
+func (b *boxContainer) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	if _, err = b.box.WriteTo(w); err != nil {
+		return
+	}
+	for _, c := range b.children {
+		if _, err = c.WriteTo(w); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Movie Header Box
+type boxMVHD struct {
+	fullBox
+	creationTime     uint32
+	modificationTime uint32
+	timescale        uint32
+	duration         uint32
+	rate             int32
+	volume           int16
+	reserved         uint16
+	reserved2        [2]uint32
+	matrix           [9]int32
+	preDefined       [6]uint32
+	nextTrackID      uint32
+}
+
+func (b *boxMVHD) Size() uint32 {
+	return b.fullBox.Size() +
+		4 /*creation_time*/ + 4 /*modification_time*/ + 4 /*timescale*/ +
+		4 /*duration*/ + 4 /*rate*/ + 2 /*volume*/ + 2 + 8 /*reserved*/ +
+		36 /*matrix*/ + 24 /*pre_defined*/ + 4 /*next_track_ID*/
+}
+
+func (b *boxMVHD) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeMVHD
+	if _, err = b.fullBox.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, b.creationTime, b.modificationTime, b.timescale,
+		b.duration, b.rate, b.volume, b.reserved, b.reserved2, b.matrix,
+		b.preDefined, b.nextTrackID)
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Track Header Box
+type boxTKHD struct {
+	fullBox
+	creationTime     uint32
+	modificationTime uint32
+	trackID          uint32
+	reserved         uint32
+	duration         uint32
+	reserved2        [2]uint32
+	layer            int16
+	alternateGroup   int16
+	volume           int16
+	reserved3        uint16
+	matrix           [9]int32
+	width            uint32 // 16.16 fixed-point
+	height           uint32 // 16.16 fixed-point
+}
+
+func (b *boxTKHD) Size() uint32 {
+	return b.fullBox.Size() +
+		4 /*creation_time*/ + 4 /*modification_time*/ + 4 /*track_ID*/ +
+		4 /*reserved*/ + 4 /*duration*/ + 8 /*reserved*/ + 2 /*layer*/ +
+		2 /*alternate_group*/ + 2 /*volume*/ + 2 /*reserved*/ +
+		36 /*matrix*/ + 4 /*width*/ + 4 /*height*/
+}
+
+func (b *boxTKHD) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeTKHD
+	if _, err = b.fullBox.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, b.creationTime, b.modificationTime, b.trackID,
+		b.reserved, b.duration, b.reserved2, b.layer, b.alternateGroup,
+		b.volume, b.reserved3, b.matrix, b.width, b.height)
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Single Track Reference Type Box, type of the box is the reference type
+type boxTREFReference struct {
+	box
+	trackIDs []uint32
+}
+
+func (r *boxTREFReference) Size() uint32 {
+	return r.box.Size() + uint32(len(r.trackIDs))*4
+}
+
+func (r *boxTREFReference) WriteTo(w io.Writer) (n int64, err error) {
+	r.size = r.Size()
+	if _, err = r.box.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, r.trackIDs)
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Edit List Box
+type boxELST struct {
+	fullBox
+	entries []boxELSTEntry
+}
+
+type boxELSTEntry struct {
+	segmentDuration   uint32
+	mediaTime         int32
+	mediaRateInteger  int16
+	mediaRateFraction int16
+}
+
+func (b *boxELST) Size() uint32 {
+	return b.fullBox.Size() + 4 /*entry_count*/ + uint32(len(b.entries))*12
+}
+
+func (b *boxELST) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeELST
+	if _, err = b.fullBox.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, uint32(len(b.entries)), b.entries)
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Media Header Box
+type boxMDHD struct {
+	fullBox
+	creationTime     uint32
+	modificationTime uint32
+	timescale        uint32
+	duration         uint32
+	language         uint16 // with pad bit
+	preDefined       uint16
+}
+
+func (b *boxMDHD) Size() uint32 {
+	return b.fullBox.Size() +
+		4 /*creation_time*/ + 4 /*modification_time*/ + 4 /*timescale*/ +
+		4 /*duration*/ + 2 /*language*/ + 2 /*pre_defined*/
+}
+
+func (b *boxMDHD) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeMDHD
+	if _, err = b.fullBox.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, b.creationTime, b.modificationTime, b.timescale,
+		b.duration, b.language, b.preDefined)
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Video Media Header Box
+type boxVMHD struct {
+	fullBox
+	graphicsMode uint16
+	opColor      [3]uint16
+}
+
+func (b *boxVMHD) Size() uint32 {
+	return b.fullBox.Size() + 2 /*graphicsmode*/ + 6 /*opcolor*/
+}
+
+func (b *boxVMHD) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeVMHD
+	if _, err = b.fullBox.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, b.graphicsMode, b.opColor)
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Data Reference Box
+type boxDREF struct {
+	fullBox
+	entries []anyBox
+}
+
+func (b *boxDREF) Size() uint32 {
+	size := b.fullBox.Size() + 4 /*entry_count*/
+	for _, e := range b.entries {
+		size += e.Size()
+	}
+	return size
+}
+
+func (b *boxDREF) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeDREF
+	if _, err = b.fullBox.WriteTo(w); err != nil {
+		return
+	}
+	if err = writeBE(w, uint32(len(b.entries))); err != nil {
+		return
+	}
+	for _, e := range b.entries {
+		if _, err = e.WriteTo(w); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Data Entry URL Box, flag 1 means that data is in the same file
+type boxURL struct {
+	fullBox
+}
+
+func (b *boxURL) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeURL
+	_, err = b.fullBox.WriteTo(w)
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Sample Description Box
+type boxSTSD struct {
+	fullBox
+	entries []anyBox
+}
+
+func (b *boxSTSD) Size() uint32 {
+	size := b.fullBox.Size() + 4 /*entry_count*/
+	for _, e := range b.entries {
+		size += e.Size()
+	}
+	return size
+}
+
+func (b *boxSTSD) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeSTSD
+	if _, err = b.fullBox.WriteTo(w); err != nil {
+		return
+	}
+	if err = writeBE(w, uint32(len(b.entries))); err != nil {
+		return
+	}
+	for _, e := range b.entries {
+		if _, err = e.WriteTo(w); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//----------------------------------------------------------------------
+
+// AV1 Sample Entry
+type boxAV01 struct {
+	box
+	reserved           [6]uint8
+	dataReferenceIndex uint16
+	preDefined         uint16
+	reserved2          uint16
+	preDefined2        [3]uint32
+	width              uint16
+	height             uint16
+	horizResolution    uint32 // 16.16 fixed-point
+	vertResolution     uint32 // 16.16 fixed-point
+	reserved3          uint32
+	frameCount         uint16
+	compressorName     [32]uint8
+	depth              uint16
+	preDefined3        int16
+	children           []anyBox
+}
+
+func (b *boxAV01) Size() uint32 {
+	size := b.box.Size() +
+		6 /*reserved*/ + 2 /*data_reference_index*/ + 2 /*pre_defined*/ +
+		2 /*reserved*/ + 12 /*pre_defined*/ + 2 /*width*/ + 2 /*height*/ +
+		4 /*horizresolution*/ + 4 /*vertresolution*/ + 4 /*reserved*/ +
+		2 /*frame_count*/ + 32 /*compressorname*/ + 2 /*depth*/ +
+		2 /*pre_defined*/
+	for _, c := range b.children {
+		size += c.Size()
+	}
+	return size
+}
+
+func (b *boxAV01) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeAV01
+	if _, err = b.box.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, b.reserved, b.dataReferenceIndex, b.preDefined,
+		b.reserved2, b.preDefined2, b.width, b.height, b.horizResolution,
+		b.vertResolution, b.reserved3, b.frameCount, b.compressorName,
+		b.depth, b.preDefined3)
+	if err != nil {
+		return
+	}
+	for _, c := range b.children {
+		if _, err = c.WriteTo(w); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Coding Constraints Box
+type boxCCST struct {
+	fullBox
+	allRefPicsIntra bool
+	intraPredUsed   bool
+	maxRefPerPic    uint8
+}
+
+func (b *boxCCST) Size() uint32 {
+	return b.fullBox.Size() + 4 /*flags and reserved*/
+}
+
+func (b *boxCCST) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeCCST
+	if _, err = b.fullBox.WriteTo(w); err != nil {
+		return
+	}
+	constraints := uint32(bflag(b.allRefPicsIntra, 8)|bflag(b.intraPredUsed, 7)|
+		(b.maxRefPerPic&0xf)<<2) << 24
+	err = writeBE(w, constraints)
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Auxiliary Type Info Box
+type boxAUXI struct {
+	fullBox
+	auxTrackType string
+}
+
+func (b *boxAUXI) Size() uint32 {
+	return b.fullBox.Size() + ulen(b.auxTrackType) + 1 /*\0*/
+}
+
+func (b *boxAUXI) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeAUXI
+	if _, err = b.fullBox.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, []byte(b.auxTrackType), []byte{0})
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Decoding Time to Sample Box
+type boxSTTS struct {
+	fullBox
+	entries []boxSTTSEntry
+}
+
+type boxSTTSEntry struct {
+	sampleCount uint32
+	sampleDelta uint32
+}
+
+func (b *boxSTTS) Size() uint32 {
+	return b.fullBox.Size() + 4 /*entry_count*/ + uint32(len(b.entries))*8
+}
+
+func (b *boxSTTS) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeSTTS
+	if _, err = b.fullBox.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, uint32(len(b.entries)), b.entries)
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Sample To Chunk Box
+type boxSTSC struct {
+	fullBox
+	entries []boxSTSCEntry
+}
+
+type boxSTSCEntry struct {
+	firstChunk             uint32
+	samplesPerChunk        uint32
+	sampleDescriptionIndex uint32
+}
+
+func (b *boxSTSC) Size() uint32 {
+	return b.fullBox.Size() + 4 /*entry_count*/ + uint32(len(b.entries))*12
+}
+
+func (b *boxSTSC) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeSTSC
+	if _, err = b.fullBox.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, uint32(len(b.entries)), b.entries)
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Sample Size Box
+type boxSTSZ struct {
+	fullBox
+	sampleSize uint32
+	entrySizes []uint32
+}
+
+func (b *boxSTSZ) Size() uint32 {
+	return b.fullBox.Size() + 4 /*sample_size*/ + 4 /*sample_count*/ +
+		uint32(len(b.entrySizes))*4
+}
+
+func (b *boxSTSZ) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeSTSZ
+	if _, err = b.fullBox.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, b.sampleSize, uint32(len(b.entrySizes)), b.entrySizes)
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Chunk Offset Box
+type boxSTCO struct {
+	fullBox
+	chunkOffsets []uint32
+}
+
+func (b *boxSTCO) Size() uint32 {
+	return b.fullBox.Size() + 4 /*entry_count*/ + uint32(len(b.chunkOffsets))*4
+}
+
+func (b *boxSTCO) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeSTCO
+	if _, err = b.fullBox.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, uint32(len(b.chunkOffsets)), b.chunkOffsets)
+	return
+}
+
+//----------------------------------------------------------------------
+
+// Sync Sample Box
+type boxSTSS struct {
+	fullBox
+	sampleNumbers []uint32
+}
+
+func (b *boxSTSS) Size() uint32 {
+	return b.fullBox.Size() + 4 /*entry_count*/ + uint32(len(b.sampleNumbers))*4
+}
+
+func (b *boxSTSS) WriteTo(w io.Writer) (n int64, err error) {
+	b.size = b.Size()
+	b.typ = boxTypeSTSS
+	if _, err = b.fullBox.WriteTo(w); err != nil {
+		return
+	}
+	err = writeBE(w, uint32(len(b.sampleNumbers)), b.sampleNumbers)
+	return
+}
+
+//----------------------------------------------------------------------
+
+// An av1Track is the sequence of coded AV1 frames stored as a track of
+// the movie.
+type av1Track struct {
+	image     *av1Image // describes every frame, obuData is not used
+	handler   fourCC
+	samples   [][]byte
+	durations []uint32 // in movie timescale units
+	keyframes []bool
+	auxOf     uint32 // ID of the master track of auxiliary track
+	itemID    uint16 // item sharing data with the first sample
+	// Filled on write.
+	chunkOffsets *boxSTCO
+}
+
+// addTrack adds track to the movie. Returns ID of the new track.
+func (m *muxer) addTrack(t *av1Track) uint32 {
+	m.tracks = append(m.tracks, t)
+	return uint32(len(m.tracks))
+}
+
+// Return duration of the whole track in movie timescale units.
+func (t *av1Track) duration() uint32 {
+	var total uint32
+	for _, d := range t.durations {
+		total += d
+	}
+	return total
+}
+
+// Return sample description of the track, codec configuration is taken
+// from the first sample.
+func (t *av1Track) sampleEntry() (*boxAV01, error) {
+	img := *t.image
+	img.obuData = t.samples[0]
+	config, err := img.config()
+	if err != nil {
+		return nil, err
+	}
+	entry := &boxAV01{
+		dataReferenceIndex: 1,
+		width:              uint16(img.width),
+		height:             uint16(img.height),
+		horizResolution:    0x00480000, // 72 dpi
+		vertResolution:     0x00480000,
+		frameCount:         1,
+		depth:              0x0018,
+		preDefined3:        -1,
+	}
+	entry.children = append(entry.children, &boxAV1C{av1Config: config})
+	if c := img.color; c != nil {
+		if len(c.iccProfile) != 0 {
+			entry.children = append(entry.children, &boxCOLR{
+				colourType: colourTypePROF,
+				iccProfile: c.iccProfile,
+			})
+		}
+		entry.children = append(entry.children, &boxCOLR{
+			colourType:              colourTypeNCLX,
+			colourPrimaries:         c.colorPrimaries,
+			transferCharacteristics: c.transferCharacteristics,
+			matrixCoefficients:      c.matrixCoefficients,
+			fullRangeFlag:           c.fullRange,
+		})
+	}
+	if !img.clap.Empty() {
+		entry.children = append(entry.children, newCLAP(int(img.width), int(img.height), img.clap))
+	}
+	// Frames refer to each other so only intra coding isn't guaranteed.
+	entry.children = append(entry.children, &boxCCST{intraPredUsed: true, maxRefPerPic: 15})
+	if t.auxOf != 0 {
+		entry.children = append(entry.children, &boxAUXI{auxTrackType: auxTypeAlpha})
+	}
+	return entry, nil
+}
+
+// Return sample table of the track. Chunk offsets are fixed later once
+// the layout of the file is known, each sample is stored in its own
+// chunk.
+func (t *av1Track) sampleTable() (*boxContainer, error) {
+	entry, err := t.sampleEntry()
+	if err != nil {
+		return nil, err
+	}
+	stts := &boxSTTS{}
+	for _, d := range t.durations {
+		if n := len(stts.entries); n > 0 && stts.entries[n-1].sampleDelta == d {
+			stts.entries[n-1].sampleCount++
+		} else {
+			stts.entries = append(stts.entries, boxSTTSEntry{1, d})
+		}
+	}
+	stsz := &boxSTSZ{}
+	for _, s := range t.samples {
+		stsz.entrySizes = append(stsz.entrySizes, uint32(len(s)))
+	}
+	t.chunkOffsets = &boxSTCO{chunkOffsets: make([]uint32, len(t.samples))}
+	stbl := newContainer(boxTypeSTBL,
+		&boxSTSD{entries: []anyBox{entry}},
+		stts,
+		&boxSTSC{entries: []boxSTSCEntry{{1, 1, 1}}},
+		stsz,
+		t.chunkOffsets,
+	)
+	// All samples are sync samples if the box is absent.
+	stss := &boxSTSS{}
+	for i, key := range t.keyframes {
+		if key {
+			stss.sampleNumbers = append(stss.sampleNumbers, uint32(i+1))
+		}
+	}
+	if len(stss.sampleNumbers) != len(t.samples) {
+		stbl.children = append(stbl.children, stss)
+	}
+	return stbl, nil
+}
+
+// Return the movie box describing tracks of the muxer. Tracks are
+// played loopCount+1 times, forever if it's 0 and once if it's -1 like
+// in GIF.
+func (m *muxer) movie() (*boxContainer, error) {
+	mvhd := &boxMVHD{
+		timescale:   m.timescale,
+		rate:        0x00010000,
+		volume:      0x0100,
+		matrix:      unityMatrix,
+		nextTrackID: uint32(len(m.tracks) + 1),
+	}
+	moov := newContainer(boxTypeMOOV, mvhd)
+	for i, t := range m.tracks {
+		mediaDuration := t.duration()
+		// Edit list with repetition flag makes the media to be repeated
+		// for the whole track duration.
+		duration := mediaDuration
+		elst := &boxELST{entries: []boxELSTEntry{{
+			segmentDuration:  mediaDuration,
+			mediaRateInteger: 1,
+		}}}
+		if m.loopCount != -1 {
+			elst.flags = 1
+		}
+		if m.loopCount == 0 {
+			duration = indefiniteDuration
+		} else if m.loopCount > 0 {
+			loops := uint64(m.loopCount) + 1
+			if uint64(mediaDuration)*loops >= indefiniteDuration {
+				return nil, MuxerError("sequence is too long")
+			}
+			duration = mediaDuration * uint32(loops)
+		}
+		mvhd.duration = duration
+		tkhd := &boxTKHD{
+			trackID:  uint32(i + 1),
+			duration: duration,
+			matrix:   unityMatrix,
+			width:    t.image.width << 16,
+			height:   t.image.height << 16,
+		}
+		tkhd.flags = 1 // enabled
+		if t.auxOf == 0 {
+			tkhd.flags |= 2 // in movie
+		}
+		stbl, err := t.sampleTable()
+		if err != nil {
+			return nil, err
+		}
+		vmhd := &boxVMHD{}
+		vmhd.flags = 1
+		url := &boxURL{}
+		url.flags = 1 // data is in this file
+		trak := newContainer(boxTypeTRAK, tkhd)
+		if t.auxOf != 0 {
+			trak.children = append(trak.children, newContainer(boxTypeTREF,
+				&boxTREFReference{box: box{typ: refTypeAUXL}, trackIDs: []uint32{t.auxOf}}))
+		}
+		trak.children = append(trak.children,
+			newContainer(boxTypeEDTS, elst),
+			newContainer(boxTypeMDIA,
+				&boxMDHD{timescale: m.timescale, duration: mediaDuration, language: languageUND},
+				&boxHDLR{handlerType: t.handler, name: m.metadata.theHandler.name},
+				newContainer(boxTypeMINF,
+					vmhd,
+					newContainer(boxTypeDINF, &boxDREF{entries: []anyBox{url}}),
+					stbl,
+				),
+			),
+		)
+		moov.children = append(moov.children, trak)
+	}
+	return moov, nil
+}
+
+func muxSequence(w io.Writer, color *av1Track, alpha *av1Track, meta *imageMetadata,
+	timescale uint32, loopCount int) (err error) {
+	m := newMuxer()
+	m.fileType.majorBrand = brandAVIS
+	m.fileType.compatibleBrands = []fourCC{
+		itemTypeAVIF, brandAVIS, brandMSF1, brandISO8, itemTypeMIF1, itemTypeMIAF,
+	}
+	m.timescale = timescale
+	m.loopCount = loopCount
+	// The first frame is also stored as the still image for viewers not
+	// supporting sequences.
+	still := *color.image
+	still.obuData = color.samples[0]
+	colorID, err := m.addImage("Image", &still)
+	if err != nil {
+		return
+	}
+	m.metadata.primaryResource.itemID = colorID
+	color.itemID = colorID
+	colorTrackID := m.addTrack(color)
+	if alpha != nil {
+		still := *alpha.image
+		still.obuData = alpha.samples[0]
+		alphaID, err := m.addImage("Alpha", &still)
+		if err != nil {
+			return err
+		}
+		m.addItemProperty(alphaID, true, &boxAUXC{auxType: auxTypeAlpha})
+		m.addReference(refTypeAUXL, alphaID, colorID)
+		alpha.itemID = alphaID
+		alpha.auxOf = colorTrackID
+		m.addTrack(alpha)
+	}
+	if meta != nil {
+		m.addMetadata(colorID, meta)
+	}
+	_, err = m.WriteTo(w)
+	return
+}
@@ -0,0 +1,308 @@
+package avif
+
+import (
+	"math"
+)
+
+// AV1 OBU types.
+const (
+	obuSequenceHeader    = 1
+	obuTemporalDelimiter = 2
+)
+
+// A bitReader reads fields of AV1 bitstream, most significant bit first.
+// Reading past the end yields zero bits and sets the error.
+type bitReader struct {
+	buf []byte
+	pos uint // in bits
+	err error
+}
+
+// Read unsigned n-bit number, f(n) in the specification.
+func (r *bitReader) f(n uint) uint32 {
+	var v uint32
+	for i := uint(0); i < n; i++ {
+		if r.pos>>3 >= uint(len(r.buf)) {
+			r.err = MuxerError("truncated OBU")
+			return 0
+		}
+		bit := r.buf[r.pos>>3] >> (7 - r.pos&7) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) flag() bool {
+	return r.f(1) != 0
+}
+
+// Read variable length unsigned number, uvlc() in the specification.
+func (r *bitReader) uvlc() uint32 {
+	leadingZeros := uint(0)
+	for r.err == nil && !r.flag() {
+		leadingZeros++
+	}
+	if leadingZeros >= 32 {
+		return math.MaxUint32
+	}
+	return r.f(leadingZeros) + (1 << leadingZeros) - 1
+}
+
+// Read unsigned little-endian base 128 number. Returns number of bytes
+// read, 0 if the number is malformed.
+func readLEB128(data []byte) (v uint64, n int) {
+	for i := 0; i < 8 && i < len(data); i++ {
+		v |= uint64(data[i]&0x7f) << (uint(i) * 7)
+		if data[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// Iterate over OBUs stored in data. Units without size field must be the
+// last ones as in the low overhead bitstream format. The whole unit
+// including its header is passed along with the payload.
+func readOBUs(data []byte, fn func(typ uint8, unit, payload []byte) error) error {
+	for len(data) > 0 {
+		header := data[0]
+		if header&0x80 != 0 {
+			return MuxerError("bad OBU header")
+		}
+		typ := (header >> 3) & 0xf
+		hdrSize := 1
+		if header&0x04 != 0 {
+			// Extension header.
+			hdrSize++
+		}
+		if hdrSize > len(data) {
+			return MuxerError("truncated OBU")
+		}
+		size := uint64(len(data) - hdrSize)
+		if header&0x02 != 0 {
+			var n int
+			if size, n = readLEB128(data[hdrSize:]); n == 0 {
+				return MuxerError("bad OBU size")
+			}
+			hdrSize += n
+			if size > uint64(len(data)-hdrSize) {
+				return MuxerError("truncated OBU")
+			}
+		}
+		end := hdrSize + int(size)
+		if err := fn(typ, data[:end], data[hdrSize:end]); err != nil {
+			return err
+		}
+		data = data[end:]
+	}
+	return nil
+}
+
+// A sequenceHeader is the part of AV1 sequence header describing the
+// format of coded frames.
+type sequenceHeader struct {
+	profile                   uint8
+	stillPicture              bool
+	reducedStillPictureHeader bool
+	levelIdx0                 uint8
+	tier0                     bool
+	maxFrameWidth             uint32
+	maxFrameHeight            uint32
+	bitDepth                  int
+	monochrome                bool
+	colorDescriptionPresent   bool
+	colorPrimaries            uint16
+	transferCharacteristics   uint16
+	matrixCoefficients        uint16
+	fullRange                 bool
+	subsamplingX              bool
+	subsamplingY              bool
+	chromaSamplePosition      uint8
+	unit                      []byte // the whole OBU
+}
+
+// Parse payload of sequence header OBU up to the colour config, the rest
+// isn't needed to describe the stream in the container.
+func parseSequenceHeader(payload []byte) (*sequenceHeader, error) {
+	r := &bitReader{buf: payload}
+	h := &sequenceHeader{}
+	h.profile = uint8(r.f(3))
+	h.stillPicture = r.flag()
+	h.reducedStillPictureHeader = r.flag()
+	if h.reducedStillPictureHeader {
+		h.levelIdx0 = uint8(r.f(5))
+	} else {
+		decoderModelInfoPresent := false
+		bufferDelayLength := uint(0)
+		if timingInfoPresent := r.flag(); timingInfoPresent {
+			r.f(32) // num_units_in_display_tick
+			r.f(32) // time_scale
+			if equalPictureInterval := r.flag(); equalPictureInterval {
+				r.uvlc() // num_ticks_per_picture_minus_1
+			}
+			decoderModelInfoPresent = r.flag()
+			if decoderModelInfoPresent {
+				bufferDelayLength = uint(r.f(5)) + 1
+				r.f(32) // num_units_in_decoding_tick
+				r.f(5)  // buffer_removal_time_length_minus_1
+				r.f(5)  // frame_presentation_time_length_minus_1
+			}
+		}
+		initialDisplayDelayPresent := r.flag()
+		operatingPoints := int(r.f(5)) + 1
+		for i := 0; i < operatingPoints; i++ {
+			r.f(12) // operating_point_idc
+			level := uint8(r.f(5))
+			tier := false
+			if level > 7 {
+				tier = r.flag()
+			}
+			if i == 0 {
+				h.levelIdx0, h.tier0 = level, tier
+			}
+			if decoderModelInfoPresent && r.flag() {
+				r.f(bufferDelayLength) // decoder_buffer_delay
+				r.f(bufferDelayLength) // encoder_buffer_delay
+				r.f(1)                 // low_delay_mode_flag
+			}
+			if initialDisplayDelayPresent && r.flag() {
+				r.f(4) // initial_display_delay_minus_1
+			}
+		}
+	}
+	frameWidthBits := uint(r.f(4)) + 1
+	frameHeightBits := uint(r.f(4)) + 1
+	h.maxFrameWidth = r.f(frameWidthBits) + 1
+	h.maxFrameHeight = r.f(frameHeightBits) + 1
+	if !h.reducedStillPictureHeader {
+		if frameIDNumbersPresent := r.flag(); frameIDNumbersPresent {
+			r.f(4) // delta_frame_id_length_minus_2
+			r.f(3) // additional_frame_id_length_minus_1
+		}
+	}
+	r.f(1) // use_128x128_superblock
+	r.f(1) // enable_filter_intra
+	r.f(1) // enable_intra_edge_filter
+	if !h.reducedStillPictureHeader {
+		r.f(1) // enable_interintra_compound
+		r.f(1) // enable_masked_compound
+		r.f(1) // enable_warped_motion
+		r.f(1) // enable_dual_filter
+		enableOrderHint := r.flag()
+		if enableOrderHint {
+			r.f(1) // enable_jnt_comp
+			r.f(1) // enable_ref_frame_mvs
+		}
+		forceScreenContentTools := uint32(2) // SELECT_SCREEN_CONTENT_TOOLS
+		if chooseScreenContentTools := r.flag(); !chooseScreenContentTools {
+			forceScreenContentTools = r.f(1)
+		}
+		if forceScreenContentTools > 0 {
+			if chooseIntegerMV := r.flag(); !chooseIntegerMV {
+				r.f(1) // seq_force_integer_mv
+			}
+		}
+		if enableOrderHint {
+			r.f(3) // order_hint_bits_minus_1
+		}
+	}
+	r.f(1) // enable_superres
+	r.f(1) // enable_cdef
+	r.f(1) // enable_restoration
+
+	// Colour config.
+	highBitdepth := r.flag()
+	h.bitDepth = 8
+	if h.profile == 2 && highBitdepth {
+		h.bitDepth = 10
+		if twelveBit := r.flag(); twelveBit {
+			h.bitDepth = 12
+		}
+	} else if highBitdepth {
+		h.bitDepth = 10
+	}
+	if h.profile != 1 {
+		h.monochrome = r.flag()
+	}
+	h.colorPrimaries = cpUnspecified
+	h.transferCharacteristics = tcUnspecified
+	h.matrixCoefficients = mcUnspecified
+	h.colorDescriptionPresent = r.flag()
+	if h.colorDescriptionPresent {
+		h.colorPrimaries = uint16(r.f(8))
+		h.transferCharacteristics = uint16(r.f(8))
+		h.matrixCoefficients = uint16(r.f(8))
+	}
+	switch {
+	case h.monochrome:
+		h.fullRange = r.flag()
+		h.subsamplingX, h.subsamplingY = true, true
+		h.chromaSamplePosition = cspUnknown
+	case h.colorPrimaries == cpBT709 && h.transferCharacteristics == tcSRGB &&
+		h.matrixCoefficients == mcIdentity:
+		h.fullRange = true
+	default:
+		h.fullRange = r.flag()
+		switch h.profile {
+		case 0:
+			h.subsamplingX, h.subsamplingY = true, true
+		case 1:
+		default:
+			if h.bitDepth == 12 {
+				h.subsamplingX = r.flag()
+				if h.subsamplingX {
+					h.subsamplingY = r.flag()
+				}
+			} else {
+				h.subsamplingX = true
+			}
+		}
+		if h.subsamplingX && h.subsamplingY {
+			h.chromaSamplePosition = uint8(r.f(2))
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if h.profile > 2 {
+		return nil, MuxerError("unsupported AV1 profile")
+	}
+	return h, nil
+}
+
+// Find sequence header among OBUs of the temporal unit.
+func findSequenceHeader(data []byte) (*sequenceHeader, error) {
+	var h *sequenceHeader
+	err := readOBUs(data, func(typ uint8, unit, payload []byte) (err error) {
+		if typ == obuSequenceHeader && h == nil {
+			if h, err = parseSequenceHeader(payload); err == nil {
+				h.unit = unit
+			}
+		}
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return nil, MuxerError("missing sequence header")
+	}
+	return h, nil
+}
+
+// Remove temporal delimiters from the temporal unit. Items and samples
+// are delimited by the container so they only waste bytes.
+func stripTemporalDelimiters(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	err := readOBUs(data, func(typ uint8, unit, payload []byte) error {
+		if typ != obuTemporalDelimiter {
+			out = append(out, unit...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,187 @@
+package avif
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+type bitWriter struct {
+	buf []byte
+	pos uint
+}
+
+func (w *bitWriter) put(v uint32, n uint) {
+	for i := n; i > 0; i-- {
+		if w.pos&7 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if v>>(i-1)&1 != 0 {
+			w.buf[len(w.buf)-1] |= 0x80 >> (w.pos & 7)
+		}
+		w.pos++
+	}
+}
+
+func (w *bitWriter) flag(b bool) {
+	if b {
+		w.put(1, 1)
+	} else {
+		w.put(0, 1)
+	}
+}
+
+func testOBU(typ uint8, payload []byte) []byte {
+	// Payloads of tests fit into single byte of size.
+	return append([]byte{typ<<3 | 0x02, uint8(len(payload))}, payload...)
+}
+
+// Return temporal unit as libaom would code the image, the frame OBU
+// carries the given bytes.
+func testTemporalUnit(img *av1Image, reduced bool, frame ...byte) []byte {
+	w := &bitWriter{}
+	profile := getSeqProfile(img.subsampling, img.depth)
+	if img.monochrome && img.depth != 12 {
+		profile = 0
+	}
+	w.put(uint32(profile), 3)
+	w.flag(reduced) // still_picture
+	w.flag(reduced)
+	const level = 8
+	if reduced {
+		w.put(level, 5)
+	} else {
+		w.put(0, 1)  // timing_info_present_flag
+		w.put(0, 1)  // initial_display_delay_present_flag
+		w.put(0, 5)  // operating_points_cnt_minus_1
+		w.put(0, 12) // operating_point_idc
+		w.put(level, 5)
+		w.put(1, 1) // seq_tier
+	}
+	w.put(15, 4)
+	w.put(15, 4)
+	w.put(img.width-1, 16)
+	w.put(img.height-1, 16)
+	if !reduced {
+		w.put(0, 1) // frame_id_numbers_present_flag
+	}
+	w.put(0, 3) // superblock size, filter intra, intra edge
+	if !reduced {
+		w.put(0, 4) // compound, warped motion, dual filter
+		w.put(1, 1) // enable_order_hint
+		w.put(3, 2) // jnt_comp, ref_frame_mvs
+		w.put(1, 1) // seq_choose_screen_content_tools
+		w.put(1, 1) // seq_choose_integer_mv
+		w.put(6, 3) // order_hint_bits_minus_1
+	}
+	w.put(3, 3) // superres, cdef, restoration
+	w.flag(img.depth > 8)
+	if profile == 2 && img.depth > 8 {
+		w.flag(img.depth == 12)
+	}
+	if profile != 1 {
+		w.flag(img.monochrome)
+	}
+	c := img.color
+	w.flag(c != nil)
+	if c != nil {
+		w.put(uint32(c.colorPrimaries), 8)
+		w.put(uint32(c.transferCharacteristics), 8)
+		w.put(uint32(c.matrixCoefficients), 8)
+	}
+	fullRange := c == nil || c.fullRange
+	if img.monochrome {
+		w.flag(fullRange)
+	} else if c != nil && c.colorPrimaries == cpBT709 &&
+		c.transferCharacteristics == tcSRGB && c.matrixCoefficients == mcIdentity {
+		// Full range 4:4:4 is implied.
+	} else {
+		w.flag(fullRange)
+		sx, sy := getSubsamplingXY(img.subsampling)
+		if profile == 2 && img.depth == 12 {
+			w.flag(sx)
+			if sx {
+				w.flag(sy)
+			}
+		}
+		if sx && sy {
+			w.put(uint32(img.chromaPos), 2)
+		}
+		w.put(0, 1) // separate_uv_delta_q
+	}
+	w.put(0, 1) // film_grain_params_present
+	w.put(1, 1) // trailing bits
+	unit := testOBU(obuTemporalDelimiter, nil)
+	unit = append(unit, testOBU(obuSequenceHeader, w.buf)...)
+	return append(unit, testOBU(6, frame)...)
+}
+
+func TestParseSequenceHeader(t *testing.T) {
+	tests := []*av1Image{
+		{subsampling: image.YCbCrSubsampleRatio420, depth: 8, chromaPos: 2},
+		{subsampling: image.YCbCrSubsampleRatio420, depth: 10, monochrome: true},
+		{subsampling: image.YCbCrSubsampleRatio422, depth: 10},
+		{subsampling: image.YCbCrSubsampleRatio444, depth: 12},
+		{subsampling: image.YCbCrSubsampleRatio444, depth: 8,
+			color: &colorConfig{cpBT709, tcSRGB, mcIdentity, true, nil}},
+		{subsampling: image.YCbCrSubsampleRatio420, depth: 12, chromaPos: 1,
+			color: &colorConfig{cpBT709, tcSRGB, mcBT709, false, nil}},
+	}
+	for i, img := range tests {
+		img.width, img.height = 300, 200
+		for _, reduced := range []bool{false, true} {
+			img.obuData = testTemporalUnit(img, reduced, 1, 2, 3)
+			c, err := img.config()
+			if err != nil {
+				t.Errorf("%d: %v", i, err)
+				continue
+			}
+			h, _ := findSequenceHeader(img.obuData)
+			if !bytes.Equal(c.configOBUs, img.obuData[2:len(img.obuData)-5]) {
+				t.Errorf("%d: got config OBUs %x", i, c.configOBUs)
+			}
+			if c.seqLevelIdx0 != 8 || c.seqTier0 == reduced || h.reducedStillPictureHeader != reduced ||
+				h.maxFrameWidth != 300 || h.maxFrameHeight != 200 {
+				t.Errorf("%d: got %+v", i, h)
+			}
+		}
+	}
+}
+
+func TestSequenceHeaderContradiction(t *testing.T) {
+	img := &av1Image{
+		width:       3,
+		height:      2,
+		subsampling: image.YCbCrSubsampleRatio420,
+		depth:       8,
+		color:       &colorConfig{cpBT709, tcSRGB, mcBT709, false, nil},
+	}
+	img.obuData = testTemporalUnit(img, false)
+	for i, change := range []func(img *av1Image){
+		func(img *av1Image) { img.depth = 10 },
+		func(img *av1Image) { img.monochrome = true },
+		func(img *av1Image) { img.subsampling = image.YCbCrSubsampleRatio444 },
+		func(img *av1Image) { img.width = 4 },
+		func(img *av1Image) { img.color = &colorConfig{cpBT709, tcSRGB, mcBT709, true, nil} },
+		func(img *av1Image) { img.color = &colorConfig{cpBT709, tcSRGB, mcBT601, false, nil} },
+		func(img *av1Image) { img.obuData = img.obuData[:len(img.obuData)-4] },
+	} {
+		bad := *img
+		change(&bad)
+		if _, err := bad.config(); err == nil {
+			t.Errorf("%d: contradiction accepted", i)
+		}
+	}
+}
+
+func TestStripTemporalDelimiters(t *testing.T) {
+	img := &av1Image{width: 3, height: 2, subsampling: image.YCbCrSubsampleRatio420, depth: 8}
+	unit := testTemporalUnit(img, true, 1, 2)
+	got, err := stripTemporalDelimiters(append(unit, testOBU(obuTemporalDelimiter, nil)...))
+	if err != nil || !bytes.Equal(got, unit[2:]) {
+		t.Errorf("got %x, %v; want %x", got, err, unit[2:])
+	}
+	if _, err := stripTemporalDelimiters(unit[:len(unit)-1]); err == nil {
+		t.Error("truncated OBU accepted")
+	}
+}
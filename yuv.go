@@ -0,0 +1,336 @@
+package avif
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sync"
+)
+
+// Colour description code points as defined in ISO/IEC 23091-4.
+const (
+	cpBT709       = 1 // also sRGB
+	cpUnspecified = 2
+	tcUnspecified = 2
+	tcSRGB        = 13
+	mcIdentity    = 0
+	mcBT709       = 1
+	mcUnspecified = 2
+	mcBT601       = 6
+	mcBT2020NCL   = 9
+)
+
+func (mc MatrixCoefficients) codePoint() uint16 {
+	switch mc {
+	case MatrixBT601:
+		return mcBT601
+	case MatrixBT2020NCL:
+		return mcBT2020NCL
+	case MatrixIdentity:
+		return mcIdentity
+	}
+	return mcBT709
+}
+
+// Number of fractional bits of the fixed-point coefficients. It's large
+// enough to keep rounding error of 16-bit input much less than 1 LSB of
+// 12-bit output.
+const yuvFracBits = 22
+
+// A yuvMatrix converts 16-bit RGB samples to YCbCr samples of the given
+// bit depth using fixed-point arithmetic.
+type yuvMatrix struct {
+	yr, yg, yb int64
+	ur, ug, ub int64
+	vr, vg, vb int64
+	yOff, cOff int64
+	max        int64
+}
+
+// Return matrix of the given type.
+func newYUVMatrix(mc MatrixCoefficients, fullRange bool, depth uint) *yuvMatrix {
+	max := float64(uint32(1)<<depth - 1)
+	mul := float64(uint32(1) << (depth - 8))
+	yScale, cScale, yOff := max, max, 0.0
+	if !fullRange {
+		yScale, cScale, yOff = 219*mul, 224*mul, 16*mul
+	}
+	// Input samples are in [0, 0xffff] range.
+	fix := func(v, scale float64) int64 {
+		return int64(math.Floor(v*scale*(1<<yuvFracBits)/0xffff + 0.5))
+	}
+	half := float64(int64(1) << (yuvFracBits - 1))
+	if mc == MatrixIdentity {
+		// All planes are scaled as luma.
+		off := int64(yOff*(1<<yuvFracBits) + half)
+		return &yuvMatrix{
+			yg:   fix(1, yScale),
+			ub:   fix(1, yScale),
+			vr:   fix(1, yScale),
+			yOff: off,
+			cOff: off,
+			max:  int64(max),
+		}
+	}
+	// Luma coefficients of red and blue components.
+	kr, kb := 0.2126, 0.0722
+	switch mc {
+	case MatrixBT601:
+		kr, kb = 0.299, 0.114
+	case MatrixBT2020NCL:
+		kr, kb = 0.2627, 0.0593
+	}
+	kg := 1 - kr - kb
+	return &yuvMatrix{
+		yr:   fix(kr, yScale),
+		yg:   fix(kg, yScale),
+		yb:   fix(kb, yScale),
+		ur:   fix(-kr/(2*(1-kb)), cScale),
+		ug:   fix(-kg/(2*(1-kb)), cScale),
+		ub:   fix(0.5, cScale),
+		vr:   fix(0.5, cScale),
+		vg:   fix(-kg/(2*(1-kr)), cScale),
+		vb:   fix(-kb/(2*(1-kr)), cScale),
+		yOff: int64(yOff*(1<<yuvFracBits) + half),
+		cOff: int64(mul*128*(1<<yuvFracBits) + half),
+		max:  int64(max),
+	}
+}
+
+func (m *yuvMatrix) clamp(v int64) uint16 {
+	v >>= yuvFracBits
+	if v < 0 {
+		return 0
+	}
+	if v > m.max {
+		return uint16(m.max)
+	}
+	return uint16(v)
+}
+
+func (m *yuvMatrix) y(r, g, b uint32) uint16 {
+	return m.clamp(m.yr*int64(r) + m.yg*int64(g) + m.yb*int64(b) + m.yOff)
+}
+
+func (m *yuvMatrix) uv(r, g, b uint32) (uint16, uint16) {
+	u := m.ur*int64(r) + m.ug*int64(g) + m.ub*int64(b) + m.cOff
+	v := m.vr*int64(r) + m.vg*int64(g) + m.vb*int64(b) + m.cOff
+	return m.clamp(u), m.clamp(v)
+}
+
+// A rowReader reads non-premultiplied 16-bit RGBA samples of the image
+// row starting at the given position into the given slice, 4 samples
+// per pixel.
+type rowReader func(x, y int, row []uint32)
+
+// Return function reading rows of the image. Common image types are
+// read directly from their buffers to avoid allocation of color.Color
+// per pixel.
+func newRowReader(m image.Image) rowReader {
+	switch m := m.(type) {
+	case *image.RGBA:
+		return func(x, y int, row []uint32) {
+			i := m.PixOffset(x, y)
+			for k, v := range m.Pix[i : i+len(row)] {
+				row[k] = uint32(v) * 0x101
+			}
+			for k := 0; k < len(row); k += 4 {
+				p := row[k : k+4 : k+4]
+				if a := p[3]; a != 0xffff && a != 0 {
+					p[0], p[1], p[2] = unpremultiply(p[0], a), unpremultiply(p[1], a),
+						unpremultiply(p[2], a)
+				}
+			}
+		}
+	case *image.NRGBA:
+		return func(x, y int, row []uint32) {
+			i := m.PixOffset(x, y)
+			for k, v := range m.Pix[i : i+len(row)] {
+				row[k] = uint32(v) * 0x101
+			}
+		}
+	case *image.YCbCr:
+		return func(x, y int, row []uint32) {
+			for k := 0; k < len(row); k += 4 {
+				yi, ci := m.YOffset(x+k/4, y), m.COffset(x+k/4, y)
+				r, g, b := color.YCbCrToRGB(m.Y[yi], m.Cb[ci], m.Cr[ci])
+				p := row[k : k+4 : k+4]
+				p[0], p[1], p[2], p[3] = uint32(r)*0x101, uint32(g)*0x101, uint32(b)*0x101, 0xffff
+			}
+		}
+	}
+	return func(x, y int, row []uint32) {
+		for k := 0; k < len(row); k += 4 {
+			r, g, b, a := m.At(x+k/4, y).RGBA()
+			// Colors are alpha-premultiplied in Go but stored as is in AVIF.
+			if a != 0xffff && a != 0 {
+				r, g, b = unpremultiply(r, a), unpremultiply(g, a), unpremultiply(b, a)
+			}
+			p := row[k : k+4 : k+4]
+			p[0], p[1], p[2], p[3] = r, g, b, a
+		}
+	}
+}
+
+// Return function reading rows of the image which replicates edge pixels
+// of the bounds for positions to the right and below them. Used for
+// tiles overlapping the image edge.
+func clampedRowReader(read rowReader, bounds image.Rectangle) rowReader {
+	return func(x, y int, row []uint32) {
+		y = clampInt(y, bounds.Min.Y, bounds.Max.Y-1)
+		n := clampInt(bounds.Max.X-x, 1, len(row)/4) * 4
+		read(x, y, row[:n])
+		for k := n; k < len(row); k += 4 {
+			copy(row[k:k+4], row[n-4:n])
+		}
+	}
+}
+
+// Return tables scaling full range 8-bit luma and chroma samples to the
+// given bit depth. Chroma is shifted so that neutral 128 stays at the
+// midpoint.
+func fullRangeScale(depth uint) (luma, chroma *[256]uint16) {
+	luma, chroma = new([256]uint16), new([256]uint16)
+	max := uint32(1)<<depth - 1
+	for v := range luma {
+		luma[v] = uint16((uint32(v)*max + 127) / 255)
+		chroma[v] = uint16(v) << (depth - 8)
+	}
+	return
+}
+
+// Copy planes of the region of YCbCr image to the frame buffer as is,
+// replicating edge samples outside of the image. Region must start inside
+// the image and subsample ratio of the image must match the one of the
+// buffer. Samples are assumed to be full range.
+func copyYCbCr(m *image.YCbCr, rec image.Rectangle, dst *frameBuffer, xMask, yMask int) {
+	lumaScale, chromaScale := fullRangeScale(dst.depth)
+	// Copy samples of the row and replicate the last one up to the width.
+	putRow := func(pos int, src []uint8, width int, scale *[256]uint16) {
+		if dst.depth == 8 {
+			copy(dst.data[pos:], src)
+		} else {
+			for k, v := range src {
+				dst.data16[pos+k] = scale[v]
+			}
+		}
+		last := scale[src[len(src)-1]]
+		for k := len(src); k < width; k++ {
+			dst.put(pos+k, last)
+		}
+	}
+	width := rec.Dx()
+	n := clampInt(m.Rect.Max.X-rec.Min.X, 1, width)
+	pos := 0
+	for y := rec.Min.Y; y < rec.Max.Y; y++ {
+		i := m.YOffset(rec.Min.X, clampInt(y, m.Rect.Min.Y, m.Rect.Max.Y-1))
+		putRow(pos, m.Y[i:i+n], width, lumaScale)
+		pos += width
+	}
+	// Chroma is addressed by its own coordinates so that the sampling
+	// grid of the image is kept for odd origins, e.g. of a sub-image.
+	cw := (rec.Dx() + xMask) >> uint(xMask)
+	ch := (rec.Dy() + yMask) >> uint(yMask)
+	cMin := image.Pt(m.Rect.Min.X>>uint(xMask), m.Rect.Min.Y>>uint(yMask))
+	cMax := image.Pt((m.Rect.Max.X-1)>>uint(xMask), (m.Rect.Max.Y-1)>>uint(yMask))
+	cx0, cy0 := rec.Min.X>>uint(xMask), rec.Min.Y>>uint(yMask)
+	cn := clampInt(cMax.X+1-cx0, 1, cw)
+	uPos := pos
+	vPos := pos + cw*ch
+	for cy := cy0; cy < cy0+ch; cy++ {
+		i := (clampInt(cy, cMin.Y, cMax.Y)-cMin.Y)*m.CStride + cx0 - cMin.X
+		putRow(uPos, m.Cb[i:i+cn], cw, chromaScale)
+		putRow(vPos, m.Cr[i:i+cn], cw, chromaScale)
+		uPos += cw
+		vPos += cw
+	}
+}
+
+// A converter fills frame buffers with YCbCr and alpha samples of the
+// image. Alpha is only checked for opacity if its buffer is not set.
+type converter struct {
+	read         rowReader
+	rec          image.Rectangle
+	matrix       *yuvMatrix
+	xMask, yMask int
+	ySize, uSize int
+	color, alpha *frameBuffer
+	// Chroma is point sampled if not set.
+	chroma *chromaSampler
+}
+
+// Minimal number of rows processed by single goroutine.
+const minConvertRows = 16
+
+// Convert the image splitting rows across the given number of
+// goroutines. Returns whether all pixels are opaque.
+func (c *converter) convert(threads int) bool {
+	height := c.rec.Dy()
+	step := (height + threads - 1) / threads
+	if step < minConvertRows {
+		step = minConvertRows
+	}
+	// Each goroutine must own whole chroma rows.
+	step = (step + c.yMask) &^ c.yMask
+	if step >= height {
+		return c.convertRows(0, height)
+	}
+	var wg sync.WaitGroup
+	opaque := make([]bool, (height+step-1)/step)
+	for n := range opaque {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			j1 := (n + 1) * step
+			if j1 > height {
+				j1 = height
+			}
+			opaque[n] = c.convertRows(n*step, j1)
+		}(n)
+	}
+	wg.Wait()
+	for _, o := range opaque {
+		if !o {
+			return false
+		}
+	}
+	return true
+}
+
+// Convert rows in [j0, j1) range relative to the image bounds along with
+// corresponding chroma rows. Chroma is only computed at sampled
+// positions.
+func (c *converter) convertRows(j0, j1 int) bool {
+	opaque := true
+	width := c.rec.Dx()
+	cw := (width + c.xMask) >> uint(c.xMask)
+	alphaShift := 16 - c.color.depth
+	row := make([]uint32, width*4)
+	for j := j0; j < j1; j++ {
+		c.read(c.rec.Min.X, c.rec.Min.Y+j, row)
+		yPos := j * width
+		uPos := c.ySize + (j>>uint(c.yMask))*cw
+		chromaRow := c.uSize != 0 && c.chroma == nil && j&c.yMask == 0
+		for i := 0; i < width; i++ {
+			p := row[i*4 : i*4+4 : i*4+4]
+			r, g, b, a := p[0], p[1], p[2], p[3]
+			if a != 0xffff {
+				opaque = false
+			}
+			c.color.put(yPos+i, c.matrix.y(r, g, b))
+			if c.alpha != nil {
+				c.alpha.put(yPos+i, uint16(a>>alphaShift))
+			}
+			if chromaRow && i&c.xMask == 0 {
+				u, v := c.matrix.uv(r, g, b)
+				c.color.put(uPos, u)
+				c.color.put(uPos+c.uSize, v)
+				uPos++
+			}
+		}
+	}
+	if c.uSize != 0 && c.chroma != nil {
+		c.convertChromaRows(j0>>uint(c.yMask), (j1+c.yMask)>>uint(c.yMask))
+	}
+	return opaque
+}
@@ -0,0 +1,247 @@
+package avif
+
+import (
+	"image"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+// Float reference of the conversion.
+func rgb2yuvFloat(mc MatrixCoefficients, fullRange bool, r16, g16, b16 uint32, depth uint) (float64, float64, float64) {
+	mul := float64(uint32(1) << (depth - 8))
+	yScale, cScale, yOff := 219*mul, 224*mul, 16*mul
+	if fullRange {
+		yScale, cScale, yOff = float64(uint32(1)<<depth-1), float64(uint32(1)<<depth-1), 0
+	}
+	r, g, b := float64(r16)/0xffff, float64(g16)/0xffff, float64(b16)/0xffff
+	if mc == MatrixIdentity {
+		return yOff + g*yScale, yOff + b*yScale, yOff + r*yScale
+	}
+	k := map[MatrixCoefficients][2]float64{
+		MatrixBT709:     {0.2126, 0.0722},
+		MatrixBT601:     {0.299, 0.114},
+		MatrixBT2020NCL: {0.2627, 0.0593},
+	}[mc]
+	kr, kb := k[0], k[1]
+	y := kr*r + (1-kr-kb)*g + kb*b
+	cb := (b - y) / (2 * (1 - kb))
+	cr := (r - y) / (2 * (1 - kr))
+	return yOff + y*yScale, 128*mul + cb*cScale, 128*mul + cr*cScale
+}
+
+func TestYUVMatrix(t *testing.T) {
+	for mc := MatrixBT709; mc <= MatrixIdentity; mc++ {
+		for _, fullRange := range []bool{false, true} {
+			for _, depth := range []uint{8, 10, 12} {
+				m := newYUVMatrix(mc, fullRange, depth)
+				for n := 0; n < 10000; n++ {
+					r, g, b := uint32(rand.Intn(0x10000)), uint32(rand.Intn(0x10000)), uint32(rand.Intn(0x10000))
+					y := m.y(r, g, b)
+					u, v := m.uv(r, g, b)
+					fy, fu, fv := rgb2yuvFloat(mc, fullRange, r, g, b, depth)
+					for _, c := range [][2]float64{{float64(y), fy}, {float64(u), fu}, {float64(v), fv}} {
+						if d := c[0] - c[1]; d > 1 || d < -1 {
+							t.Fatalf("%d %v %d-bit %v %v %v: got %v, want %v",
+								mc, fullRange, depth, r, g, b, c[0], c[1])
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCopyYCbCr(t *testing.T) {
+	m := image.NewYCbCr(image.Rect(0, 0, 6, 4), image.YCbCrSubsampleRatio420)
+	for i := range m.Y {
+		m.Y[i] = 255
+	}
+	for i := range m.Cb {
+		m.Cb[i] = uint8(i)
+		m.Cr[i] = uint8(255 - i)
+	}
+	// Sub-image with odd origin keeps chroma grid of the parent.
+	sub := m.SubImage(image.Rect(1, 1, 6, 4)).(*image.YCbCr)
+	rec := sub.Bounds()
+	ySize, uSize := rec.Dx()*rec.Dy(), 3*2
+	dst := newFrameBuffer(ySize+uSize*2, 10)
+	defer dst.free()
+	copyYCbCr(sub, rec, dst, 1, 1)
+	for i, v := range dst.data16[:ySize] {
+		if v != 1023 {
+			t.Fatalf("luma %d: got %d, want 1023", i, v)
+		}
+	}
+	_, scale := fullRangeScale(10)
+	for cy := 0; cy < 2; cy++ {
+		for cx := 0; cx < 3; cx++ {
+			i := cy*3 + cx
+			want := m.Cb[cy*m.CStride+cx]
+			if u := dst.data16[ySize+i]; u != scale[want] {
+				t.Errorf("chroma (%d, %d): got %d, want %d", cx, cy, u, scale[want])
+			}
+			if v := dst.data16[ySize+uSize+i]; v != scale[255-want] {
+				t.Errorf("chroma (%d, %d): got %d, want %d", cx, cy, v, scale[255-want])
+			}
+		}
+	}
+}
+
+func TestFullRangeScale(t *testing.T) {
+	for _, depth := range []uint{8, 10, 12} {
+		luma, chroma := fullRangeScale(depth)
+		max, mid := uint16(1)<<depth-1, uint16(1)<<(depth-1)
+		if luma[0] != 0 || luma[255] != max {
+			t.Errorf("%d-bit: luma range is %d..%d, want 0..%d", depth, luma[0], luma[255], max)
+		}
+		// Neutral chroma must not be tinted.
+		if chroma[128] != mid {
+			t.Errorf("%d-bit: chroma 128 is %d, want %d", depth, chroma[128], mid)
+		}
+		if chroma[255] > max {
+			t.Errorf("%d-bit: chroma 255 is %d, exceeds %d", depth, chroma[255], max)
+		}
+	}
+}
+
+func TestClampedRowReader(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(1, 1, 4, 3))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i)
+	}
+	read := clampedRowReader(newRowReader(m), m.Bounds())
+	tests := []struct {
+		x, y int
+		want []image.Point // source pixels
+	}{
+		{1, 1, []image.Point{{1, 1}, {2, 1}, {3, 1}}},
+		{2, 2, []image.Point{{2, 2}, {3, 2}, {3, 2}, {3, 2}}},
+		{3, 4, []image.Point{{3, 2}, {3, 2}}},
+		{1, 5, []image.Point{{1, 2}, {2, 2}, {3, 2}, {3, 2}, {3, 2}}},
+	}
+	for _, test := range tests {
+		row := make([]uint32, len(test.want)*4)
+		read(test.x, test.y, row)
+		for k, pt := range test.want {
+			i := m.PixOffset(pt.X, pt.Y)
+			for c := 0; c < 4; c++ {
+				if want := uint32(m.Pix[i+c]) * 0x101; row[k*4+c] != want {
+					t.Errorf("(%d, %d) pixel %d: got %#x, want %#x of %v",
+						test.x, test.y, k, row[k*4+c], want, pt)
+				}
+			}
+		}
+	}
+}
+
+func TestCopyYCbCrEdge(t *testing.T) {
+	m := image.NewYCbCr(image.Rect(0, 0, 3, 3), image.YCbCrSubsampleRatio420)
+	for i := range m.Y {
+		m.Y[i] = uint8(i)
+	}
+	for i := range m.Cb {
+		m.Cb[i] = uint8(100 + i)
+		m.Cr[i] = uint8(200 + i)
+	}
+	// Tile overlapping the right and bottom edges.
+	rec := image.Rect(0, 0, 6, 6)
+	ySize, uSize := 6*6, 3*3
+	dst := newFrameBuffer(ySize+uSize*2, 8)
+	defer dst.free()
+	copyYCbCr(m, rec, dst, 1, 1)
+	clamp := func(v, max int) int {
+		if v > max {
+			return max
+		}
+		return v
+	}
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 6; x++ {
+			want := m.Y[m.YOffset(clamp(x, 2), clamp(y, 2))]
+			if got := dst.data[y*6+x]; got != want {
+				t.Errorf("luma (%d, %d): got %d, want %d", x, y, got, want)
+			}
+		}
+	}
+	for cy := 0; cy < 3; cy++ {
+		for cx := 0; cx < 3; cx++ {
+			i := clamp(cy, 1)*m.CStride + clamp(cx, 1)
+			if got := dst.data[ySize+cy*3+cx]; got != m.Cb[i] {
+				t.Errorf("Cb (%d, %d): got %d, want %d", cx, cy, got, m.Cb[i])
+			}
+			if got := dst.data[ySize+uSize+cy*3+cx]; got != m.Cr[i] {
+				t.Errorf("Cr (%d, %d): got %d, want %d", cx, cy, got, m.Cr[i])
+			}
+		}
+	}
+}
+
+func newBenchImage() *image.NRGBA {
+	// 24MP, 6000x4000.
+	m := image.NewNRGBA(image.Rect(0, 0, 6000, 4000))
+	rand.Read(m.Pix)
+	return m
+}
+
+func benchmarkConvert(b *testing.B, threads int) {
+	m := newBenchImage()
+	rec := m.Bounds()
+	ySize := rec.Dx() * rec.Dy()
+	uSize := (rec.Dx() + 1) / 2 * ((rec.Dy() + 1) / 2)
+	color := newFrameBuffer(ySize+uSize*2, 8)
+	defer color.free()
+	alpha := newFrameBuffer(ySize, 8)
+	defer alpha.free()
+	c := &converter{
+		read:   newRowReader(m),
+		rec:    rec,
+		matrix: newYUVMatrix(MatrixBT709, false, 8),
+		xMask:  1,
+		yMask:  1,
+		ySize:  ySize,
+		uSize:  uSize,
+		color:  color,
+		alpha:  alpha,
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		c.convert(threads)
+	}
+}
+
+func BenchmarkConvert24MP(b *testing.B) {
+	benchmarkConvert(b, 1)
+}
+
+func BenchmarkConvert24MPParallel(b *testing.B) {
+	benchmarkConvert(b, runtime.NumCPU())
+}
+
+// Conversion as it was done before: float math, chroma is computed for
+// every pixel.
+func BenchmarkConvert24MPFloat(b *testing.B) {
+	m := newBenchImage()
+	rec := m.Bounds()
+	ySize := rec.Dx() * rec.Dy()
+	uSize := (rec.Dx() + 1) / 2 * ((rec.Dy() + 1) / 2)
+	color := newFrameBuffer(ySize+uSize*2, 8)
+	defer color.free()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		yPos, uPos := 0, ySize
+		for j := rec.Min.Y; j < rec.Max.Y; j++ {
+			for i := rec.Min.X; i < rec.Max.X; i++ {
+				r16, g16, b16, _ := m.At(i, j).RGBA()
+				y, u, v := rgb2yuvFloat(MatrixBT709, false, r16, g16, b16, 8)
+				color.put(yPos, uint16(y))
+				yPos++
+				if i&1 == 0 && j&1 == 0 {
+					color.put(uPos, uint16(u))
+					color.put(uPos+uSize, uint16(v))
+					uPos++
+				}
+			}
+		}
+	}
+}